@@ -0,0 +1,171 @@
+// Copyright 2013 Chad Williamson.
+
+// This file is part of Turgenev, a chess program.
+
+// Turgenev is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Turgenev is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License along
+// with Turgenev. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+// ActivityScore() returns the middlegame and endgame piece activity scores
+// for the given player: mobility, rooks on open files and the seventh rank,
+// and knight outposts.
+func (s *State) ActivityScore(e *Evaluator, player Color) (mg, eg int) {
+	own, enemy := s.occupiedBy(player), s.pawnAttacks(Opponent(player))
+	p := e.Params
+
+	for i := 0; i < 8; i++ {
+		for j := 0; j < 8; j++ {
+			if s.GetColor(i, j) != player {
+				continue
+			}
+			piece := s.GetPiece(i, j)
+			if piece == Pawn || piece == King {
+				continue
+			}
+
+			// Squares held by our own pieces or guarded by enemy pawns
+			// don't count toward mobility.
+			mobility := popCount(s.AttackSet(i, j) &^ own &^ enemy)
+			mg += (mobility - p.TypicalMobility[piece]) * p.MgMobility[piece]
+			eg += (mobility - p.TypicalMobility[piece]) * p.EgMobility[piece]
+
+			switch (piece) {
+			case Rook:
+				rm, re := s.rookActivity(p, player, i, j)
+				mg, eg = mg + rm, eg + re
+			case Knight:
+				if s.knightOutpost(player, i, j) {
+					mg += p.MgKnightOutpost
+					eg += p.EgKnightOutpost
+				}
+			}
+		}
+	}
+
+	return
+}
+
+// BishopPairScore() returns the given player's bonus for having bishops
+// on both colors of square, which shrinks with the pawns on the board.
+func (s *State) BishopPairScore(e *Evaluator, player Color) (mg, eg int) {
+	light, dark := false, false
+
+	for i := 0; i < 8; i++ {
+		for j := 0; j < 8; j++ {
+			if s.GetPiece(i, j) == Bishop && s.GetColor(i, j) == player {
+				if (i + j) % 2 == 1 {
+					light = true
+				} else {
+					dark = true
+				}
+			}
+		}
+	}
+
+	if light && dark {
+		pawns := s.countPieces(Pawn)
+		mg = e.Params.MgBishopPair - e.Params.BishopPairPawn * pawns
+		eg = e.Params.EgBishopPair - e.Params.BishopPairPawn * pawns
+	}
+
+	return
+}
+
+// Score a rook on (row, col) for standing on an open or half-open file, or
+// on the seventh rank when the enemy king or pawns are still on the back
+// ranks.
+func (s *State) rookActivity(p *EvalParams, player Color, row, col int) (mg, eg int) {
+	if !s.pawnOnFile(player, col) {
+		if s.pawnOnFile(Opponent(player), col) {
+			mg, eg = p.MgRookSemiOpenFile, p.EgRookSemiOpenFile
+		} else {
+			mg, eg = p.MgRookOpenFile, p.EgRookOpenFile
+		}
+	}
+
+	if RelativeRank(player, row) == 6 {
+		kingRow, _, _ := s.FindKing(Opponent(player))
+		pawns := false
+		for j := 0; j < 8; j++ {
+			if s.GetPiece(row, j) == Pawn && s.GetColor(row, j) == Opponent(player) {
+				pawns = true
+			}
+		}
+		if pawns || RelativeRank(player, kingRow) == 7 {
+			mg += p.MgRookOnSeventh
+			eg += p.EgRookOnSeventh
+		}
+	}
+
+	return
+}
+
+// A knight is on an outpost if it stands on the fourth to sixth rank,
+// defended by a pawn, where no enemy pawn can ever chase it away.
+func (s *State) knightOutpost(player Color, row, col int) bool {
+	rank := RelativeRank(player, row)
+	if rank < 3 || rank > 5 {
+		return false
+	}
+	if s.pawnAttacks(player) & squareBit(row, col) == 0 {
+		return false
+	}
+
+	return !s.pawnsAhead(player, Opponent(player), row, col - 1, col - 1) &&
+	       !s.pawnsAhead(player, Opponent(player), row, col + 1, col + 1)
+}
+
+// Return the squares occupied by the given player's pieces.
+func (s *State) occupiedBy(player Color) uint64 {
+	var set uint64
+
+	for i := 0; i < 8; i++ {
+		for j := 0; j < 8; j++ {
+			if s.GetColor(i, j) == player {
+				set |= squareBit(i, j)
+			}
+		}
+	}
+
+	return set
+}
+
+// Return the squares attacked by the given player's pawns.
+func (s *State) pawnAttacks(player Color) uint64 {
+	var set uint64
+
+	for i := 0; i < 8; i++ {
+		for j := 0; j < 8; j++ {
+			if s.GetPiece(i, j) == Pawn && s.GetColor(i, j) == player {
+				set |= s.AttackSet(i, j)
+			}
+		}
+	}
+
+	return set
+}
+
+// Return the number of pieces of the given type on the board (of either
+// color).
+func (s *State) countPieces(piece Piece) int {
+	count := 0
+
+	for i := 0; i < 64; i++ {
+		if Piece(s.board[i] & pieceMask) == piece {
+			count++
+		}
+	}
+
+	return count
+}
@@ -0,0 +1,121 @@
+// Copyright 2013 Chad Williamson.
+
+// This file is part of Turgenev, a chess program.
+
+// Turgenev is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Turgenev is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License along
+// with Turgenev. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+// Attack sets are bitmasks with a bit per square, bit (row << 3) + col.
+
+// Directions in which each sliding and leaping piece moves.
+var (
+	knightSteps = [8][2]int{{2, 1}, {2, -1}, {1, 2}, {1, -2},
+				{-1, 2}, {-1, -2}, {-2, 1}, {-2, -1}}
+	kingSteps = [8][2]int{{1, 0}, {1, 1}, {0, 1}, {-1, 1},
+			      {-1, 0}, {-1, -1}, {0, -1}, {1, -1}}
+	diagonalSteps = [4][2]int{{1, 1}, {1, -1}, {-1, 1}, {-1, -1}}
+	straightSteps = [4][2]int{{1, 0}, {-1, 0}, {0, 1}, {0, -1}}
+)
+
+// AttackSet() returns the squares attacked by the piece on (row, col). For
+// sliding pieces the first occupied square in each direction is included,
+// whatever its color.
+func (s *State) AttackSet(row, col int) uint64 {
+	var set uint64
+
+	switch (s.GetPiece(row, col)) {
+	case Pawn:
+		forward := 1
+		if s.GetColor(row, col) == Black {
+			forward = -1
+		}
+		set |= squareBit(row + forward, col - 1)
+		set |= squareBit(row + forward, col + 1)
+	case Knight:
+		for _, step := range knightSteps {
+			set |= squareBit(row + step[0], col + step[1])
+		}
+	case Bishop:
+		set |= s.slide(row, col, diagonalSteps[:])
+	case Rook:
+		set |= s.slide(row, col, straightSteps[:])
+	case Queen:
+		set |= s.slide(row, col, diagonalSteps[:])
+		set |= s.slide(row, col, straightSteps[:])
+	case King:
+		for _, step := range kingSteps {
+			set |= squareBit(row + step[0], col + step[1])
+		}
+	}
+
+	return set
+}
+
+// AttackedBy() returns all the squares attacked by the given player.
+func (s *State) AttackedBy(player Color) uint64 {
+	var set uint64
+
+	for i := 0; i < 8; i++ {
+		for j := 0; j < 8; j++ {
+			if s.GetColor(i, j) == player {
+				set |= s.AttackSet(i, j)
+			}
+		}
+	}
+
+	return set
+}
+
+// Return the squares reached by sliding from (row, col) in each of the given
+// directions, up to and including the first occupied square.
+func (s *State) slide(row, col int, steps [][2]int) uint64 {
+	var set uint64
+
+	for _, step := range steps {
+		i, j := row + step[0], col + step[1]
+		for onBoard(i, j) {
+			set |= squareBit(i, j)
+			if s.GetPiece(i, j) != Empty {
+				break
+			}
+			i, j = i + step[0], j + step[1]
+		}
+	}
+
+	return set
+}
+
+// Return true iff (row, col) is on the board
+func onBoard(row, col int) bool {
+	return row >= 0 && row < 8 && col >= 0 && col < 8
+}
+
+// Return the bit for square (row, col), or 0 if it's off the board
+func squareBit(row, col int) uint64 {
+	if !onBoard(row, col) {
+		return 0
+	}
+	return 1 << uint((row << 3) + col)
+}
+
+// Return the number of squares in an attack set
+func popCount(set uint64) int {
+	count := 0
+	for set != 0 {
+		set &= set - 1
+		count++
+	}
+	return count
+}
@@ -0,0 +1,83 @@
+// Copyright 2013 Chad Williamson.
+
+// This file is part of Turgenev, a chess program.
+
+// Turgenev is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Turgenev is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License along
+// with Turgenev. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+)
+
+// BenchPositions are a fixed suite of positions for measuring the search:
+// some openings, some tactical middlegames and a few endgames.
+var BenchPositions = []string{
+	InitialFEN,
+	"r1bqkbnr/pppp1ppp/2n5/4p3/4P3/5N2/PPPP1PPP/RNBQKB1R w KQkq - 2 3",
+	"r1bq1rk1/ppp2ppp/2np1n2/2b1p3/2B1P3/2PP1N2/PP3PPP/RNBQ1RK1 w - - 0 7",
+	"r3k2r/p1ppqpb1/bn2pnp1/3PN3/1p2P3/2N2Q1p/PPPBBPPP/R3K2R w KQkq - 0 1",
+	"2r3k1/pp3ppp/2n5/3p4/3P4/2N5/PP3PPP/2R3K1 w - - 0 1",
+	"6k1/5ppp/8/8/8/8/5PPP/3R2K1 w - - 0 1",
+	"8/2p5/3p4/KP5r/1R3p1k/8/4P1P1/8 w - - 0 1",
+	"8/8/4k3/8/2p5/8/B2K4/8 w - - 0 1",
+}
+
+// Bench() is the "bench" subcommand, which searches each of the
+// BenchPositions to a fixed depth and reports the nodes and time taken.
+// The search's selectivity can be switched off to measure what it buys.
+func Bench(args []string) int {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	depth := flags.Int("depth", 4, "search depth")
+	noNull := flags.Bool("nonull", false, "disable null-move pruning")
+	noLMR := flags.Bool("nolmr", false, "disable late move reductions")
+	noExt := flags.Bool("noext", false, "disable check extensions")
+	flags.Parse(args)
+
+	NullMovePruning = !*noNull
+	LateMoveReductions = !*noLMR
+	CheckExtensions = !*noExt
+
+	totalNodes, totalTime, totalStats := 0, time.Duration(0), SearchStats{}
+	for i, fen := range BenchPositions {
+		s, err := StateFromFEN(fen)
+		if err != nil {
+			panic(err)
+		}
+
+		sc := NewSearch(DefaultEvaluator)
+		c := NegamaxST(sc, s, *depth)
+		move := "none"
+		if c != nil {
+			move = MoveString(s, c, Algebraic)
+		}
+		fmt.Printf("%2d  %-8s%10s%12d nodes%10.2f s\n", i + 1, move,
+			   ScoreString(sc.LastScore, Xboard), sc.Nodes, sc.WallTime.Seconds())
+
+		totalNodes += sc.Nodes
+		totalTime += sc.WallTime
+		totalStats.PVSResearches += sc.Stats.PVSResearches
+		totalStats.LMRResearches += sc.Stats.LMRResearches
+		totalStats.AspirationResearches += sc.Stats.AspirationResearches
+	}
+
+	fmt.Printf("\nTotal: %d nodes in %.2f s (%.0f nodes/s)\n", totalNodes,
+		   totalTime.Seconds(), float64(totalNodes) / totalTime.Seconds())
+	fmt.Printf("Re-searches: %d PVS, %d LMR, %d aspiration\n",
+		   totalStats.PVSResearches, totalStats.LMRResearches,
+		   totalStats.AspirationResearches)
+	return 0
+}
@@ -51,11 +51,14 @@ const (
 	movedMask = 0x20
 )
 
-// The fundamental representation of the state of the board
+// The fundamental representation of the state of the board. The halfmove
+// clock is only kept for the position a game or search starts from; see
+// HalfmoveClock().
 type State struct {
 	board []square
 	toMove Color
 	predecessor *State
+	halfmoves int
 }
 
 // Create a new state (an empty board)
@@ -71,6 +74,7 @@ func CopyState(s *State) *State {
 	copy(t.board, s.board)
 	t.toMove = s.toMove
 	t.predecessor = s.predecessor
+	t.halfmoves = s.halfmoves
 	return t
 }
 
@@ -94,6 +98,30 @@ func (s *State) SetPredecessor(p *State) {
 	s.predecessor = p
 }
 
+// Return the number of plies played to reach a state (that is, the length
+// of its chain of predecessors)
+func (s *State) Ply() int {
+	ply := 0
+	for p := s.predecessor; p != nil; p = p.predecessor {
+		ply++
+	}
+	return ply
+}
+
+// HalfmoveClock() returns the number of plies since the last capture or
+// pawn move, counting back through s's predecessors to the position it
+// started from (whose clock came from its FEN).
+func (s *State) HalfmoveClock() int {
+	clock := 0
+	for ; s.predecessor != nil; s = s.predecessor {
+		if s.predecessor.zeroing(s) {
+			return clock
+		}
+		clock++
+	}
+	return clock + s.halfmoves
+}
+
 // Return the color of the piece in square (row, col)
 func (s *State) GetColor(row, col int) Color {
 	return Color((s.board[(row << 3) + col] & colorMask) >> 3)
@@ -244,44 +272,49 @@ func (s *State) LegalSuccessors() *list.List {
 
 	// Loop through the list of successors to s, removing those that are invalid.
 	for e := l.Front(); e != nil; {
-		successor := e.Value.(*State)
-		successorResults := successor.Successors()
-		valid, castled := true, false
-
-		// it is illegal to put oneself in check...
-		for f := successorResults.Front(); f != nil; f = f.Next() {
-			successorResult := f.Value.(*State)
-			if successorResult.LostKing() {
-				valid = false
-				break
-			}
+		next := e.Next()
+		if !s.legalSuccessor(e.Value.(*State), sInCheck) {
+			l.Remove(e)
 		}
+		e = next
+	}
 
-		// Let's see if we castled...
-		differences := 0
-		for i := 0; i < 8; i++ {
-			for j := 0; j < 8; j++ {
-				if s.getSquare(i, j) != successor.getSquare(i, j) {
-					differences++
-				}
-			}
+	return l
+}
+
+// Return true iff the player to move has at least one legal move. This is
+// much cheaper than checking the length of LegalSuccessors(), since it stops
+// at the first legal move it finds.
+func (s *State) HasLegalMove() bool {
+	l := s.Successors()
+
+	for e := l.Front(); e != nil; e = e.Next() {
+		successor := e.Value.(*State)
+
+		// Castling can be skipped: whenever it's legal, so is moving the
+		// king one square toward the rook.
+		if s.castled(successor) {
+			continue
 		}
-		if differences == 4 {
-			castled = true
+		if s.legalSuccessor(successor, false) {
+			return true
 		}
+	}
 
-		if valid && castled {
-			// it is illegal to castle out of check...
-			if sInCheck {
-				valid = false
-			// it is illegal to castle through check...
-			} else if s.castledThroughCheck(successor, successorResults) {
-				valid = false
-			}
-		}
+	return false
+}
 
-		next := e.Next()
-		if !valid {
+// Return a list of the legal successors of s that capture a piece or promote
+// a pawn (the "noisy" moves that a quiescence search looks at)
+func (s *State) Captures() *list.List {
+	l, player := s.Successors(), s.GetToMove()
+	enemies, pawns := popCount(s.occupiedBy(Opponent(player))), s.countPieces(Pawn)
+
+	for e := l.Front(); e != nil; {
+		t, next := e.Value.(*State), e.Next()
+		noisy := popCount(t.occupiedBy(Opponent(player))) < enemies ||
+			 t.countPieces(Pawn) < pawns
+		if !noisy || s.castled(t) || !s.legalSuccessor(t, false) {
 			l.Remove(e)
 		}
 		e = next
@@ -290,6 +323,69 @@ func (s *State) LegalSuccessors() *list.List {
 	return l
 }
 
+// Return the squares a piece moved from and to in going from state s to its
+// successor t. (For castling, these are the king's squares.)
+func MoveSquares(s, t *State) (r1, c1, r2, c2 int) {
+	player, castled := s.GetToMove(), s.castled(t)
+
+	for i := 0; i < 8; i++ {
+		for j := 0; j < 8; j++ {
+			if s.getSquare(i, j) == t.getSquare(i, j) {
+				continue
+			}
+			if t.GetPiece(i, j) == Empty && s.GetColor(i, j) == player &&
+			   (s.GetPiece(i, j) == King || !castled) {
+				r1, c1 = i, j
+			} else if t.GetColor(i, j) == player &&
+				  (t.GetPiece(i, j) == King || !castled) {
+				r2, c2 = i, j
+			}
+		}
+	}
+
+	return
+}
+
+// Return true iff t is a legal successor of s. (Takes whether s is in check
+// to avoid recomputing it for every successor.)
+func (s *State) legalSuccessor(t *State, sInCheck bool) bool {
+	tResults := t.Successors()
+
+	// it is illegal to put oneself in check...
+	for f := tResults.Front(); f != nil; f = f.Next() {
+		if f.Value.(*State).LostKing() {
+			return false
+		}
+	}
+
+	if s.castled(t) {
+		// it is illegal to castle out of check...
+		if sInCheck {
+			return false
+		}
+		// it is illegal to castle through check...
+		if s.castledThroughCheck(t, tResults) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Return true iff moving from s to t is castling
+func (s *State) castled(t *State) bool {
+	differences := 0
+	for i := 0; i < 8; i++ {
+		for j := 0; j < 8; j++ {
+			if s.getSquare(i, j) != t.getSquare(i, j) {
+				differences++
+			}
+		}
+	}
+
+	return differences == 4
+}
+
 // Return a list of states that could legally follow if not for restrictions
 // on putting oneself in check or castling through/out-of check. Offered
 // because it's faster than its stricter counterpart (and front-end),
@@ -617,13 +713,13 @@ func pushKings(l *list.List, s *State, row, col int) {
 	}
 
 	if (player == White && row != 0) || (player == Black && row != 7) ||
-	   s.GetMoved(row, col) {
+	   col != 4 || s.GetMoved(row, col) {
 		return
 	}
 
 	// King's side castling...
 	if s.GetColor(row, 5) == None && s.GetColor(row, 6) == None &&
-	   !s.GetMoved(row, 7) {
+	   s.unmovedRook(row, 7, player) {
 		cs := CopyState(s)
 		cs.SetPredecessor(s)
 		cs.setSquare(row, 6, s.getSquare(row, 4))
@@ -640,7 +736,7 @@ func pushKings(l *list.List, s *State, row, col int) {
 
 	// Queen's side castling...
 	if s.GetColor(row, 1) == None && s.GetColor(row, 2) == None &&
-	   s.GetColor(row, 3) == None && !s.GetMoved(row, 7) {
+	   s.GetColor(row, 3) == None && s.unmovedRook(row, 0, player) {
 		cs := CopyState(s)
 		cs.SetPredecessor(s)
 		cs.setSquare(row, 2, s.getSquare(row, 4))
@@ -656,6 +752,13 @@ func pushKings(l *list.List, s *State, row, col int) {
 	}
 }
 
+// Return true iff (row, col) holds one of the player's rooks that has never
+// moved (and so may still castle)
+func (s *State) unmovedRook(row, col int, player Color) bool {
+	return s.GetPiece(row, col) == Rook && s.GetColor(row, col) == player &&
+	       !s.GetMoved(row, col)
+}
+
 // Helper for the pushSomePiece functions. Appends the particular state
 // created by moving a piece from (r, c) to (r + dr, c + dc)
 func pushMoveResult(l *list.List, s *State, r, c, dr, dc int) {
@@ -0,0 +1,930 @@
+// Copyright 2013 Chad Williamson.
+
+// This file is part of Turgenev, a chess program.
+
+// Turgenev is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Turgenev is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License along
+// with Turgenev. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Turgenev can also make its own endgame tables for small material sets
+// (up to four pieces, kings included), by retrograde analysis: starting
+// from the checkmates, positions are worked backwards a ply at a time, a
+// position being won as soon as one of its moves reaches a lost one and
+// lost once all of its moves reach won ones. Whatever is left is drawn.
+// The tables hold the distance to mate, in plies, of every position. En
+// passant and castling are left out.
+
+// Endgame table settings. Tables are loaded from the directory
+// EndgamePath, and only probed while EndgameProbing is set.
+var (
+	EndgamePath string = ""
+	EndgameProbing bool = true
+	EndgameTables = make(map[string]*EndgameTable)
+
+	// The most pieces in any loaded table
+	endgamePieces int = 0
+)
+
+// Name of the engine option for the endgame tables
+const EndgamePathOption = "EndgamePath"
+
+const (
+	// The most pieces (kings included) a table may have
+	MaxEndgamePieces = 4
+
+	endgameMagic = "TGEG"
+	endgameExt = ".tgeg"
+)
+
+// An EndgameTable holds, for each position of a material set, 0 if the
+// position is drawn (or impossible) and otherwise 1 plus the number of
+// plies to mate: odd distances are wins for the player to move and even
+// ones losses.
+//
+// The material is written like a Syzygy table's name, stronger side first
+// ("KRvK"), and that side plays White in the table. A position is indexed
+// by the player to move, the square of White's king and the squares of the
+// other pieces in the order of the name. Since the board's symmetries
+// don't change a position's value, only the position with the lowest index
+// among its mirror images (those with White's king in the a1-d1-d4
+// triangle, or on files a-d if there are pawns) is stored.
+type EndgameTable struct {
+	Code string
+	Values []byte
+
+	pieces []Piece
+	colors []Color
+	pawns bool
+}
+
+// NewEndgameTable() returns an empty table for the given material.
+func NewEndgameTable(code string) (*EndgameTable, error) {
+	if !validTablebaseCode(code) {
+		return nil, errors.New("bad material: " + code)
+	}
+	if len(code) - 1 > MaxEndgamePieces {
+		return nil, fmt.Errorf("%s has more than %d pieces", code, MaxEndgamePieces)
+	}
+
+	t := &EndgameTable{Code: canonicalCode(code)}
+	for i, side := range strings.Split(t.Code, "v") {
+		color := White
+		if i == 1 {
+			color = Black
+		}
+		for _, r := range side {
+			t.pieces = append(t.pieces, PieceFromRune(r))
+			t.colors = append(t.colors, color)
+			if r == 'P' {
+				t.pawns = true
+			}
+		}
+	}
+
+	t.Values = make([]byte, 2 * t.regionSize() << uint(6 * (len(t.pieces) - 1)))
+
+	return t, nil
+}
+
+// Return the material code with each side's pieces in order and the stronger
+// side first: the one with more queens, or else more rooks, and so on
+func canonicalCode(code string) string {
+	sides := strings.Split(code, "v")
+	sides[0], sides[1] = sortedSide(sides[0]), sortedSide(sides[1])
+
+	for _, r := range "QRBNP" {
+		n0, n1 := strings.Count(sides[0], string(r)), strings.Count(sides[1], string(r))
+		if n0 > n1 {
+			break
+		}
+		if n1 > n0 {
+			return sides[1] + "v" + sides[0]
+		}
+	}
+	return sides[0] + "v" + sides[1]
+}
+
+// EndgameCode() returns the material of s, written as an endgame table's
+// name.
+func (s *State) EndgameCode() string {
+	return canonicalCode(s.materialKey())
+}
+
+// SetEndgamePath() loads all of the endgame tables in the directory path.
+// An empty path unloads them.
+func SetEndgamePath(path string) error {
+	EndgameTables, endgamePieces, EndgamePath = make(map[string]*EndgameTable), 0, path
+	if path == "" {
+		return nil
+	}
+
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if filepath.Ext(f.Name()) != endgameExt {
+			continue
+		}
+		t, err := LoadEndgameTable(filepath.Join(path, f.Name()))
+		if err != nil {
+			return err
+		}
+		AddEndgameTable(t)
+	}
+
+	return nil
+}
+
+// AddEndgameTable() makes a table available for probing.
+func AddEndgameTable(t *EndgameTable) {
+	EndgameTables[t.Code] = t
+	if len(t.pieces) > endgamePieces {
+		endgamePieces = len(t.pieces)
+	}
+}
+
+// LoadEndgameTable() reads a table written by Save().
+func LoadEndgameTable(path string) (*EndgameTable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	z, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	r := bufio.NewReader(z)
+
+	header, err := r.ReadString('\n')
+	fields := strings.Fields(header)
+	if err != nil || len(fields) != 2 || fields[0] != endgameMagic {
+		return nil, errors.New("not an endgame table: " + path)
+	}
+
+	t, err := NewEndgameTable(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if _, err := io.ReadFull(r, t.Values); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	return t, nil
+}
+
+// Save() writes the table to the given directory, gzipped, with a one-line
+// header giving its material.
+func (t *EndgameTable) Save(dir string) error {
+	f, err := os.Create(filepath.Join(dir, t.Code + endgameExt))
+	if err != nil {
+		return err
+	}
+
+	z := gzip.NewWriter(f)
+	fmt.Fprintf(z, "%s %s\n", endgameMagic, t.Code)
+	if _, err := z.Write(t.Values); err != nil {
+		f.Close()
+		return err
+	}
+	if err := z.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ProbeEndgame() looks s up in the endgame tables, returning WDLWin, WDLDraw
+// or WDLLoss for the player to move and the number of plies to mate, or
+// false if there's no table for s.
+func (s *State) ProbeEndgame() (wdl, plies int, ok bool) {
+	if !EndgameProbing || endgamePieces == 0 ||
+	   popCount(s.occupiedBy(White) | s.occupiedBy(Black)) > endgamePieces {
+		return
+	}
+	if _, _, ep := s.EnPassantTarget(); ep || s.CastlingRights() != "" {
+		return
+	}
+
+	t := EndgameTables[s.EndgameCode()]
+	if t == nil {
+		return
+	}
+
+	wdl, plies = endgameResult(t.Values[t.StateIndex(s)])
+	return wdl, plies, true
+}
+
+// EndgameValue() converts the result of ProbeEndgame() into a search score
+// for a position ply moves from the root.
+func EndgameValue(wdl, plies, ply int) int {
+	switch wdl {
+	case WDLWin:
+		return Mate - (ply + plies)
+	case WDLLoss:
+		return -(Mate - (ply + plies))
+	}
+	return 0
+}
+
+// Split a stored value into a result and a distance to mate
+func endgameResult(value byte) (wdl, plies int) {
+	if value == 0 {
+		return WDLDraw, 0
+	}
+
+	plies = int(value) - 1
+	if plies % 2 == 1 {
+		return WDLWin, plies
+	}
+	return WDLLoss, plies
+}
+
+// Return the number of squares White's king may be on in an index
+func (t *EndgameTable) regionSize() int {
+	if t.pawns {
+		return 32
+	}
+	return 10
+}
+
+// Return true iff an index may have White's king on sq
+func (t *EndgameTable) inRegion(sq int) bool {
+	if t.pawns {
+		return sq & 7 < 4
+	}
+	return sq & 7 < 4 && offA1H8(sq) <= 0
+}
+
+// Return the square of White's king for its number in an index
+func (t *EndgameTable) regionSquare(n int) int {
+	if t.pawns {
+		return n >> 2 << 3 + n & 3
+	}
+	for sq := 0; sq < 28; sq++ {
+		if t.inRegion(sq) && tbMapA1D1D4[sq] == n {
+			return sq
+		}
+	}
+	return -1
+}
+
+// Return the index for the given player to move and squares, White's king
+// being in the region
+func (t *EndgameTable) index(stm int, squares []int) int {
+	idx := stm * t.regionSize()
+	if t.pawns {
+		idx += squares[0] >> 3 << 2 + squares[0] & 7
+	} else {
+		idx += tbMapA1D1D4[squares[0]]
+	}
+
+	for _, sq := range squares[1:] {
+		idx = idx << 6 + sq
+	}
+	return idx
+}
+
+// Return the player to move and the squares of the pieces for an index
+func (t *EndgameTable) decode(idx int) (stm int, squares []int) {
+	squares = make([]int, len(t.pieces))
+	for i := len(squares) - 1; i > 0; i-- {
+		squares[i] = idx & 63
+		idx >>= 6
+	}
+	squares[0] = t.regionSquare(idx % t.regionSize())
+	return idx / t.regionSize(), squares
+}
+
+// Return the index of the stored mirror image of the position
+func (t *EndgameTable) canonical(stm int, squares []int) int {
+	symmetries := 8
+	if t.pawns {
+		symmetries = 2
+	}
+
+	best, mirrored := -1, make([]int, len(squares))
+	for sym := 0; sym < symmetries; sym++ {
+		for i, sq := range squares {
+			mirrored[i] = mirrorSquare(sq, sym)
+		}
+		if !t.inRegion(mirrored[0]) {
+			continue
+		}
+
+		// Identical pieces are interchangeable, so put them in order.
+		for i := 1; i < len(t.pieces); {
+			j := i + 1
+			for j < len(t.pieces) && t.pieces[j] == t.pieces[i] && t.colors[j] == t.colors[i] {
+				j++
+			}
+			sort.Ints(mirrored[i:j])
+			i = j
+		}
+
+		if idx := t.index(stm, mirrored); best < 0 || idx < best {
+			best = idx
+		}
+	}
+
+	return best
+}
+
+// Return the square sq is taken to by one of the board's eight symmetries:
+// bit 0 of sym mirrors the files, bit 1 the ranks and bit 2 the a1-h8
+// diagonal.
+func mirrorSquare(sq, sym int) int {
+	if sym & 1 != 0 {
+		sq ^= 7
+	}
+	if sym & 2 != 0 {
+		sq ^= 56
+	}
+	if sym & 4 != 0 {
+		sq = (sq >> 3 | sq << 3) & 63
+	}
+	return sq
+}
+
+// StateIndex() returns the index of s (which must have the table's
+// material). If the table's White is Black in s, the colors are swapped and
+// the board turned around.
+func (t *EndgameTable) StateIndex(s *State) int {
+	flip := s.materialKey() != t.Code
+	stm := 0
+	if (s.GetToMove() == Black) != flip {
+		stm = 1
+	}
+
+	squares, used := make([]int, len(t.pieces)), make([]bool, len(t.pieces))
+	for sq := 0; sq < 64; sq++ {
+		piece := Piece(s.board[sq] & pieceMask)
+		if piece == Empty {
+			continue
+		}
+		color, to := Color((s.board[sq] & colorMask) >> 3), sq
+		if flip {
+			color, to = Opponent(color), sq ^ 56
+		}
+		for i := range t.pieces {
+			if !used[i] && t.pieces[i] == piece && t.colors[i] == color {
+				squares[i], used[i] = to, true
+				break
+			}
+		}
+	}
+
+	return t.canonical(stm, squares)
+}
+
+// Return the position for an index, or nil if it's impossible or not the
+// stored mirror image
+func (t *EndgameTable) state(idx int) *State {
+	stm, squares := t.decode(idx)
+	if squares[0] < 0 || t.canonical(stm, squares) != idx {
+		return nil
+	}
+
+	s := CreateState()
+	for i, sq := range squares {
+		row := sq >> 3
+		if s.GetPiece(row, sq & 7) != Empty ||
+		   (t.pieces[i] == Pawn && (row == 0 || row == 7)) {
+			return nil
+		}
+		s.SetPiece(row, sq & 7, t.pieces[i])
+		s.SetColor(row, sq & 7, t.colors[i])
+		s.SetMoved(row, sq & 7, t.pieces[i] != Pawn)
+	}
+	s.SetToMove(White)
+	if stm == 1 {
+		s.SetToMove(Black)
+	}
+
+	// The player who just moved can't be in check.
+	if s.kingAttacked(Opponent(s.GetToMove())) {
+		return nil
+	}
+	return s
+}
+
+// Return true iff the player's king is attacked (or missing)
+func (s *State) kingAttacked(player Color) bool {
+	row, col, found := s.FindKing(player)
+	return !found || s.AttackedBy(Opponent(player)) & squareBit(row, col) != 0
+}
+
+// Return the legal successors of a position without castling. This is much
+// cheaper than LegalSuccessors().
+func (s *State) endgameSuccessors() []*State {
+	var moves []*State
+
+	for e := s.Successors().Front(); e != nil; e = e.Next() {
+		t := e.Value.(*State)
+		if !t.kingAttacked(s.GetToMove()) {
+			moves = append(moves, t)
+		}
+	}
+
+	return moves
+}
+
+// Return the positions from which the player who just moved could have
+// reached s without capturing or promoting
+func (s *State) endgamePredecessors() []*State {
+	player, enemy := Opponent(s.GetToMove()), s.GetToMove()
+	var preds []*State
+
+	// Pieces other than pawns move back just as they move forward.
+	u := CopyState(s)
+	u.SetPredecessor(nil)
+	u.SetToMove(player)
+	enemies := popCount(s.occupiedBy(enemy))
+	for e := u.Successors().Front(); e != nil; e = e.Next() {
+		t := e.Value.(*State)
+		r1, c1, _, _ := MoveSquares(u, t)
+		if u.GetPiece(r1, c1) != Pawn && popCount(t.occupiedBy(enemy)) == enemies {
+			preds = append(preds, t)
+		}
+	}
+
+	back, second := -1, 1
+	if player == Black {
+		back, second = 1, 6
+	}
+	for sq := 0; sq < 64; sq++ {
+		row, col := sq >> 3, sq & 7
+		if u.GetPiece(row, col) != Pawn || u.GetColor(row, col) != player {
+			continue
+		}
+		for _, from := range []int{row + back, row + 2 * back} {
+			if from < 1 || from > 6 || u.GetPiece(from, col) != Empty ||
+			   (from == row + 2 * back && (from != second ||
+						      u.GetPiece(row + back, col) != Empty)) {
+				continue
+			}
+			t := CopyState(u)
+			t.setSquare(from, col, u.getSquare(row, col))
+			t.ClearSquare(row, col)
+			preds = append(preds, t)
+		}
+	}
+
+	legal := preds[:0]
+	for _, t := range preds {
+		t.SetPredecessor(nil)
+		t.SetToMove(player)
+		if !t.kingAttacked(enemy) {
+			legal = append(legal, t)
+		}
+	}
+	return legal
+}
+
+// Return the value for the player to move of a position with different
+// material, from its own table (which has to be there already)
+func endgameExitValue(s *State) (byte, error) {
+	if popCount(s.occupiedBy(White) | s.occupiedBy(Black)) == 2 {
+		return 0, nil
+	}
+
+	t := EndgameTables[s.EndgameCode()]
+	if t == nil {
+		return 0, errors.New("no endgame table for " + s.EndgameCode())
+	}
+	return t.Values[t.StateIndex(s)], nil
+}
+
+// EndgameDependencies() returns the materials that captures and promotions
+// lead to from the given one.
+func EndgameDependencies(code string) []string {
+	var deps []string
+	seen := make(map[string]bool)
+	add := func(c string) {
+		c = canonicalCode(c)
+		if c != "KvK" && !seen[c] {
+			seen[c] = true
+			deps = append(deps, c)
+		}
+	}
+
+	sides := strings.Split(code, "v")
+	for i, side := range sides {
+		other := sides[1 - i]
+		for j := 1; j < len(side); j++ {
+			add(side[:j] + side[j + 1:] + "v" + other)
+			if side[j] == 'P' {
+				for _, r := range "QRBN" {
+					add(sortedSide(side[:j] + string(r) + side[j + 1:]) + "v" + other)
+				}
+			}
+		}
+	}
+
+	return deps
+}
+
+// Return a side's pieces in the order of a table's name
+func sortedSide(side string) string {
+	var b strings.Builder
+	for _, r := range "KQRBNP" {
+		b.WriteString(strings.Repeat(string(r), strings.Count(side, string(r))))
+	}
+	return b.String()
+}
+
+// An endgameGenerator holds the working data of GenerateEndgame(), by index.
+type endgameGenerator struct {
+	table *EndgameTable
+	threads int
+
+	// Whether the position is possible, and whether it has a drawing
+	// capture or promotion
+	valid, drawExit []bool
+
+	// How many distinct positions of the same material the position's
+	// moves lead to that aren't yet known to be won for the opponent
+	count []byte
+
+	// The quickest win and the slowest loss by capture or promotion, as
+	// stored values (0 for none)
+	exitWin, exitLoss []byte
+
+	// Positions to settle at each distance: those decided by captures and
+	// promotions, and then the ones found by working backwards
+	pending [][]int
+}
+
+// GenerateEndgame() builds the table for the given material, by retrograde
+// analysis split between the given number of goroutines. The tables its
+// captures and promotions lead to must already be in EndgameTables.
+func GenerateEndgame(code string, threads int) (*EndgameTable, error) {
+	t, err := NewEndgameTable(code)
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(t.Values)
+	g := &endgameGenerator{table: t, threads: threads,
+			       valid: make([]bool, n), drawExit: make([]bool, n),
+			       count: make([]byte, n), exitWin: make([]byte, n),
+			       exitLoss: make([]byte, n)}
+	if err := g.start(); err != nil {
+		return nil, err
+	}
+
+	for plies := 0; plies < len(g.pending); plies++ {
+		if plies > 254 {
+			return nil, errors.New(code + ": mates too long to store")
+		}
+
+		var frontier []int
+		for _, idx := range g.pending[plies] {
+			if t.Values[idx] == 0 {
+				t.Values[idx] = byte(plies + 1)
+				frontier = append(frontier, idx)
+			}
+		}
+
+		for _, preds := range g.predecessors(frontier) {
+			for _, idx := range preds {
+				if t.Values[idx] != 0 {
+					continue
+				}
+
+				// Anything that can reach a lost position is won...
+				if plies % 2 == 0 {
+					g.add(plies + 1, idx)
+					continue
+				}
+
+				// ...and anything whose moves all reach won positions
+				// is lost, unless it has a way out.
+				g.count[idx]--
+				if g.count[idx] == 0 && g.exitWin[idx] == 0 && !g.drawExit[idx] {
+					loss := plies + 1
+					if exit := int(g.exitLoss[idx]) - 1; exit > loss {
+						loss = exit
+					}
+					g.add(loss, idx)
+				}
+			}
+		}
+	}
+
+	return t, nil
+}
+
+// Queue a position to be settled at the given distance
+func (g *endgameGenerator) add(plies, idx int) {
+	for len(g.pending) <= plies {
+		g.pending = append(g.pending, nil)
+	}
+	g.pending[plies] = append(g.pending[plies], idx)
+}
+
+// Look at every position's moves: count those that keep the material and
+// score those that don't, and queue the checkmates and the positions the
+// captures and promotions decide.
+func (g *endgameGenerator) start() error {
+	t := g.table
+	errs := make([]error, g.threads)
+	var wg sync.WaitGroup
+
+	for w := 0; w < g.threads; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for idx := w; idx < len(t.Values); idx += g.threads {
+				if err := g.look(idx); err != nil {
+					errs[w] = err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	for idx := range t.Values {
+		switch {
+		case !g.valid[idx]:
+		case g.exitWin[idx] != 0:
+			g.add(int(g.exitWin[idx]) - 1, idx)
+		case g.count[idx] == 0 && g.exitLoss[idx] != 0 && !g.drawExit[idx]:
+			g.add(int(g.exitLoss[idx]) - 1, idx)
+		}
+	}
+	return nil
+}
+
+// Look at the moves of the position with the given index
+func (g *endgameGenerator) look(idx int) error {
+	t := g.table
+	s := t.state(idx)
+	if s == nil {
+		return nil
+	}
+	g.valid[idx] = true
+
+	moves := s.endgameSuccessors()
+	if len(moves) == 0 {
+		if s.kingAttacked(s.GetToMove()) {
+			g.exitLoss[idx] = 1 // mated: lost in 0 plies
+		}
+		return nil
+	}
+
+	children := make(map[int]bool)
+	for _, child := range moves {
+		if child.EndgameCode() == t.Code {
+			children[t.StateIndex(child)] = true
+			continue
+		}
+
+		value, err := endgameExitValue(child)
+		if err != nil {
+			return err
+		}
+		wdl, plies := endgameResult(value)
+		switch {
+		case wdl == WDLDraw:
+			g.drawExit[idx] = true
+		case wdl == WDLLoss && (g.exitWin[idx] == 0 || int(g.exitWin[idx]) > plies + 2):
+			g.exitWin[idx] = byte(plies + 2)
+		case wdl == WDLWin && int(g.exitLoss[idx]) < plies + 2:
+			g.exitLoss[idx] = byte(plies + 2)
+		}
+	}
+	g.count[idx] = byte(len(children))
+
+	return nil
+}
+
+// Return the distinct indices of the predecessors of each position in the
+// frontier, split between the goroutines
+func (g *endgameGenerator) predecessors(frontier []int) [][]int {
+	t := g.table
+	preds := make([][]int, len(frontier))
+	var wg sync.WaitGroup
+
+	for w := 0; w < g.threads; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < len(frontier); i += g.threads {
+				seen := make(map[int]bool)
+				for _, p := range t.state(frontier[i]).endgamePredecessors() {
+					idx := t.StateIndex(p)
+					if !seen[idx] {
+						seen[idx] = true
+						preds[i] = append(preds[i], idx)
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	return preds
+}
+
+// VerifyEndgame() cross-checks a table on n random positions: every value
+// has to follow from the values of the position's moves, and short mates
+// have to be found by the search (at a depth of up to maxPlies, with the
+// tables switched off). It returns the number of positions that fail.
+func VerifyEndgame(t *EndgameTable, n, maxPlies int) int {
+	defer func(probing, null, lmr bool) {
+		EndgameProbing, NullMovePruning, LateMoveReductions = probing, null, lmr
+	}(EndgameProbing, NullMovePruning, LateMoveReductions)
+	NullMovePruning, LateMoveReductions = false, false
+
+	r, failures := rand.New(rand.NewSource(SessionStart)), 0
+	for checked := 0; checked < n; {
+		idx := r.Intn(len(t.Values))
+		s := t.state(idx)
+		if s == nil {
+			continue
+		}
+		checked++
+
+		EndgameProbing = true
+		expected, err := forwardValue(s)
+		if err != nil || expected != t.Values[idx] {
+			fmt.Printf("%s: stored %d, moves give %d\n", s.FEN(), t.Values[idx], expected)
+			failures++
+			continue
+		}
+
+		wdl, plies := endgameResult(expected)
+		if wdl == WDLDraw || plies == 0 || plies > maxPlies {
+			continue
+		}
+		EndgameProbing = false
+		sc := NewSearch(DefaultEvaluator)
+		NegamaxST(sc, s, plies)
+		if sc.LastScore != EndgameValue(wdl, plies, 0) {
+			fmt.Printf("%s: stored mate in %d plies, search scores %s\n", s.FEN(),
+				   plies, ScoreString(sc.LastScore, UCI))
+			failures++
+		}
+	}
+
+	return failures
+}
+
+// Return the value a position should have, given the values of its moves
+func forwardValue(s *State) (byte, error) {
+	moves := s.endgameSuccessors()
+	if len(moves) == 0 {
+		if s.kingAttacked(s.GetToMove()) {
+			return 1, nil
+		}
+		return 0, nil
+	}
+
+	win, loss, draw := 0, 0, false
+	for _, child := range moves {
+		value, err := endgameExitValue(child)
+		if err != nil {
+			return 0, err
+		}
+		wdl, plies := endgameResult(value)
+		switch {
+		case wdl == WDLDraw:
+			draw = true
+		case wdl == WDLLoss && (win == 0 || plies + 1 < win):
+			win = plies + 1
+		case wdl == WDLWin && plies + 1 > loss:
+			loss = plies + 1
+		}
+	}
+
+	switch {
+	case win > 0:
+		return byte(win + 1), nil
+	case draw:
+		return 0, nil
+	}
+	return byte(loss + 1), nil
+}
+
+// MakeEndgame() returns the table for the given material, generating it
+// (and the tables it depends on) unless it's already loaded or in dir. New
+// tables are saved to dir.
+func MakeEndgame(code, dir string, threads int) (*EndgameTable, error) {
+	code = canonicalCode(code)
+	if t := EndgameTables[code]; t != nil {
+		return t, nil
+	}
+
+	// Verifying a table looks up its captures and promotions, so the
+	// tables they lead to are needed even if this one is on disk.
+	for _, dep := range EndgameDependencies(code) {
+		if _, err := MakeEndgame(dep, dir, threads); err != nil {
+			return nil, err
+		}
+	}
+
+	if t, err := LoadEndgameTable(filepath.Join(dir, code + endgameExt)); err == nil {
+		AddEndgameTable(t)
+		return t, nil
+	}
+
+	fmt.Printf("Generating %s...\n", code)
+	t, err := GenerateEndgame(code, threads)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.Save(dir); err != nil {
+		return nil, err
+	}
+	AddEndgameTable(t)
+
+	return t, nil
+}
+
+// Endgames() is the "endgames" subcommand, which generates the endgame
+// tables for the materials given on the command line (written like
+// "KRvK") and, optionally, verifies them.
+func Endgames(args []string) int {
+	flags := flag.NewFlagSet("endgames", flag.ExitOnError)
+	dir := flags.String("dir", ".", "directory to write the tables to")
+	threads := flags.Int("threads", Threads, "number of goroutines generating each table")
+	verify := flags.Int("verify", 0, "number of random positions to cross-check in each table")
+	depth := flags.Int("depth", 3, "longest mate (in plies) to cross-check with the search")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "endgames: no materials given")
+		return 2
+	}
+
+	status := 0
+	for _, code := range flags.Args() {
+		t, err := MakeEndgame(code, *dir, *threads)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "endgames:", err)
+			return 1
+		}
+
+		wins, losses, longest := 0, 0, 0
+		for _, value := range t.Values {
+			switch wdl, plies := endgameResult(value); wdl {
+			case WDLWin:
+				wins++
+				if plies > longest {
+					longest = plies
+				}
+			case WDLLoss:
+				losses++
+			}
+		}
+		fmt.Printf("%s: %d wins and %d losses for the player to move, longest mate %d plies\n",
+			   t.Code, wins, losses, longest)
+
+		if *verify > 0 {
+			failures := VerifyEndgame(t, *verify, *depth)
+			fmt.Printf("%s: %d of %d positions verified\n", t.Code, *verify - failures, *verify)
+			if failures > 0 {
+				status = 1
+			}
+		}
+	}
+
+	return status
+}
@@ -0,0 +1,114 @@
+// Copyright 2013 Chad Williamson.
+
+// This file is part of Turgenev, a chess program.
+
+// Turgenev is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Turgenev is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License along
+// with Turgenev. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+// Start the test with no endgame tables loaded, and unload those it makes
+// when it's done.
+func unloadEndgames(t *testing.T) {
+	if err := SetEndgamePath(""); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		SetEndgamePath("")
+	})
+}
+
+func TestMakeEndgame(t *testing.T) {
+	unloadEndgames(t)
+	dir := t.TempDir()
+
+	for _, test := range []struct {
+		code string
+		longest int
+		fen string
+		wdl, plies int
+	}{
+		// Mate in 10 with a queen and in 16 with a rook, at the most
+		{"KQvK", 19, "8/8/8/5k2/8/8/1Q6/K7 w - - 0 1", WDLWin, 19},
+		{"KQvK", 19, "8/8/8/8/4k3/8/1Q6/K7 b - - 0 1", WDLLoss, 20},
+		{"KRvK", 31, "8/8/8/8/8/3k4/2R5/1K6 w - - 0 1", WDLWin, 31},
+		{"KRvK", 31, "8/8/8/8/8/8/2Rk4/1K6 b - - 0 1", WDLLoss, 32},
+	} {
+		table, err := MakeEndgame(test.code, dir, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		longest := 0
+		for _, value := range table.Values {
+			if wdl, plies := endgameResult(value); wdl == WDLWin && plies > longest {
+				longest = plies
+			}
+		}
+		if longest != test.longest {
+			t.Errorf("%s: longest mate in %d plies, want %d", test.code, longest, test.longest)
+		}
+
+		// The same position with the colors swapped is found by turning
+		// it around.
+		s := mustFEN(t, test.fen)
+		for _, s := range []*State{s, tbImage(s, 0, true)} {
+			if wdl, plies, ok := s.ProbeEndgame(); !ok || wdl != test.wdl || plies != test.plies {
+				t.Errorf("%s: %d in %d plies, %t; want %d in %d", s.FEN(), wdl, plies, ok,
+					 test.wdl, test.plies)
+			}
+		}
+
+		if failures := VerifyEndgame(table, 200, 3); failures != 0 {
+			t.Errorf("%s: %d positions fail verification", test.code, failures)
+		}
+
+		saved, err := LoadEndgameTable(filepath.Join(dir, test.code + endgameExt))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if saved.Code != table.Code || !bytes.Equal(saved.Values, table.Values) {
+			t.Errorf("%s: table read back as %s, differently", test.code, saved.Code)
+		}
+	}
+}
+
+// A table loaded from disk can only be verified if the tables its captures
+// and promotions lead to are loaded too.
+func TestMakeEndgameDependencies(t *testing.T) {
+	unloadEndgames(t)
+	dir := t.TempDir()
+	if _, err := MakeEndgame("KPvK", dir, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	unloadEndgames(t)
+	table, err := MakeEndgame("KPvK", dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dep := range EndgameDependencies("KPvK") {
+		if EndgameTables[dep] == nil {
+			t.Errorf("%s isn't loaded", dep)
+		}
+	}
+	if failures := VerifyEndgame(table, 100, 0); failures != 0 {
+		t.Errorf("%d positions fail verification", failures)
+	}
+}
@@ -0,0 +1,442 @@
+// Copyright 2013 Chad Williamson.
+
+// This file is part of Turgenev, a chess program.
+
+// Turgenev is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Turgenev is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License along
+// with Turgenev. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An ExternalEngine is a chess engine running in another process, which we
+// talk to over the xboard or UCI protocol. It can play in a match like one
+// of our own configurations, searching each move to a depth or for a time.
+//
+// Every move, the engine is sent the whole game so far, so it doesn't have
+// to remember anything between moves; that way one engine can play several
+// games at once (though it only searches in one of them at a time).
+type ExternalEngine struct {
+	Label string
+	Protocol IOMode
+	Depth int
+	MoveTime time.Duration
+
+	cmd *exec.Cmd
+	in io.WriteCloser
+	lines chan string
+	lock sync.Mutex
+
+	// Whether an xboard engine wants its moves sent with "usermove"
+	usermove bool
+}
+
+const (
+	// How long an engine gets to start up or to answer "isready"
+	engineStartTimeout = 10 * time.Second
+
+	// How long an engine may take for a move beyond its search time, or
+	// at all when it searches to a depth
+	engineMoveGrace = 5 * time.Second
+	engineDepthTimeout = 10 * time.Minute
+)
+
+// errEngineTimeout is readUntil()'s error when the engine doesn't answer in
+// time.
+var errEngineTimeout = errors.New("timed out")
+
+// StartEngine() runs an engine (a command line, split at spaces) and sets
+// it up to talk over the given protocol, Xboard or UCI.
+func StartEngine(command string, protocol IOMode) (*ExternalEngine, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, errors.New("no engine command given")
+	}
+	if protocol != Xboard && protocol != UCI {
+		return nil, errors.New("engines have to speak xboard or UCI")
+	}
+
+	e := &ExternalEngine{Label: filepath.Base(args[0]), Protocol: protocol,
+			     cmd: exec.Command(args[0], args[1:]...), lines: make(chan string, 64)}
+	var err error
+	if e.in, err = e.cmd.StdinPipe(); err != nil {
+		return nil, err
+	}
+	out, err := e.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = e.cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		scanner := bufio.NewScanner(out)
+		for scanner.Scan() {
+			e.lines <- scanner.Text()
+		}
+		close(e.lines)
+	}()
+
+	if protocol == UCI {
+		err = e.startUCI()
+	} else {
+		err = e.startXboard()
+	}
+	if err != nil {
+		e.Close()
+		return nil, fmt.Errorf("%s: %v", e.Label, err)
+	}
+	return e, nil
+}
+
+// Start talking UCI: ask for the engine's name and wait until it's ready
+func (e *ExternalEngine) startUCI() error {
+	e.send("uci")
+	if err := e.readUntil("uciok", engineStartTimeout, func(fields []string) {
+		if len(fields) > 2 && fields[0] == "id" && fields[1] == "name" {
+			e.Label = strings.Join(fields[2:], " ")
+		}
+	}); err != nil {
+		return err
+	}
+
+	e.send("isready")
+	return e.readUntil("readyok", engineStartTimeout, nil)
+}
+
+// Start talking xboard: read the engine's features (accepting them all) and
+// have it post its thinking
+func (e *ExternalEngine) startXboard() error {
+	e.send("xboard")
+	e.send("protover 2")
+
+	done := false
+	err := e.readUntil("", engineStartTimeout, func(fields []string) {
+		if len(fields) == 0 || fields[0] != "feature" {
+			return
+		}
+		for _, feature := range xboardFeatures(strings.Join(fields[1:], " ")) {
+			switch feature[0] {
+			case "myname":
+				e.Label = feature[1]
+			case "usermove":
+				e.usermove = feature[1] == "1"
+			case "done":
+				done = feature[1] == "1"
+			}
+			e.send("accepted " + feature[0])
+		}
+	}, func() bool { return done })
+
+	// Engines that don't know protover 2 never say they're done.
+	if err != nil && !done && err != io.EOF {
+		err = nil
+	}
+	e.send("post")
+	return err
+}
+
+// Split the arguments of an xboard "feature" command into names and values,
+// with any quotes around the values removed
+func xboardFeatures(args string) [][2]string {
+	var features [][2]string
+
+	for args = strings.TrimSpace(args); args != ""; args = strings.TrimSpace(args) {
+		eq := strings.Index(args, "=")
+		if eq < 0 {
+			break
+		}
+		name, rest := args[:eq], args[eq + 1:]
+
+		end := strings.IndexAny(rest + " ", " ")
+		value := rest[:end]
+		if strings.HasPrefix(rest, "\"") {
+			if q := strings.Index(rest[1:], "\""); q >= 0 {
+				end = q + 2
+				value = rest[1:q + 1]
+			}
+		}
+		features = append(features, [2]string{name, value})
+		args = rest[end:]
+	}
+
+	return features
+}
+
+// Name() returns the engine's name, as it gave it.
+func (e *ExternalEngine) Name() string {
+	return e.Label
+}
+
+// Move() sends the engine the game leading to s and has it choose a move.
+// It returns nil if the engine resigns, doesn't answer in time or makes an
+// illegal move.
+func (e *ExternalEngine) Move(s *State) (*State, string, int, bool) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	start, moves := GameMoves(s)
+	timeout := engineDepthTimeout
+	if e.MoveTime > 0 {
+		timeout = e.MoveTime + engineMoveGrace
+	}
+
+	began := time.Now()
+	var move string
+	var err error
+	score, scored, depth, scoreText := 0, false, 0, ""
+	if e.Protocol == UCI {
+		position := "position startpos"
+		if fen := start.FEN(); fen != InitialFEN {
+			position = "position fen " + fen
+		}
+		if len(moves) > 0 {
+			position += " moves " + strings.Join(moves, " ")
+		}
+		e.send(position)
+
+		switch {
+		case e.MoveTime > 0:
+			e.send(fmt.Sprintf("go movetime %d", e.MoveTime.Nanoseconds() / 1000000))
+		default:
+			e.send(fmt.Sprintf("go depth %d", e.Depth))
+		}
+
+		err = e.readUntil("bestmove", timeout, func(fields []string) {
+			if fields[0] == "bestmove" && len(fields) > 1 {
+				move = fields[1]
+			}
+			if fields[0] != "info" {
+				return
+			}
+		info:
+			for i := 1; i + 1 < len(fields); i++ {
+				switch fields[i] {
+				case "string":
+					// The rest of the line is free text.
+					break info
+				case "depth":
+					depth, _ = strconv.Atoi(fields[i + 1])
+				case "score":
+					if i + 2 >= len(fields) {
+						break info
+					}
+					n, convErr := strconv.Atoi(fields[i + 2])
+					if convErr != nil {
+						continue
+					}
+					if fields[i + 1] == "cp" {
+						score, scored = n, true
+						scoreText = fmt.Sprintf("%+.2f", float64(n) / 100)
+					} else if fields[i + 1] == "mate" {
+						score, scored = mateCentipawns(n), true
+						scoreText = mateText(n)
+					}
+				}
+			}
+		})
+	} else {
+		e.send("new")
+		e.send("force")
+		if fen := start.FEN(); fen != InitialFEN {
+			e.send("setboard " + fen)
+		}
+		for _, m := range moves {
+			if e.usermove {
+				m = "usermove " + m
+			}
+			e.send(m)
+		}
+		if e.MoveTime > 0 {
+			e.send(fmt.Sprintf("st %d", int(math.Ceil(e.MoveTime.Seconds()))))
+		} else {
+			e.send(fmt.Sprintf("sd %d", e.Depth))
+		}
+		e.send("go")
+
+		err = e.readUntil("", timeout, func(fields []string) {
+			switch {
+			case fields[0] == "move" && len(fields) > 1:
+				move = fields[1]
+			case fields[0] == "resign":
+				move = "resign"
+			case len(fields) >= 5:
+				// Thinking output: ply score time nodes pv
+				d, err1 := strconv.Atoi(fields[0])
+				n, err2 := strconv.Atoi(fields[1])
+				if err1 != nil || err2 != nil {
+					break
+				}
+				depth, score, scored = d, n, true
+				scoreText = fmt.Sprintf("%+.2f", float64(n) / 100)
+				switch {
+				case n > 100000:
+					score, scoreText = mateCentipawns(n - 100000), mateText(n - 100000)
+				case n < -100000:
+					score, scoreText = mateCentipawns(n + 100000), mateText(n + 100000)
+				}
+			}
+		}, func() bool { return move != "" })
+	}
+
+	// An engine that's out of time still owes us a move, which mustn't
+	// be taken for its answer in the next position it's sent.
+	if err == errEngineTimeout {
+		e.stop()
+	}
+
+	comment := ""
+	if scored {
+		comment = fmt.Sprintf("%s/%d %.1fs", scoreText, depth, time.Since(began).Seconds())
+	}
+	if err != nil || move == "" || move == "resign" {
+		return nil, comment, score, scored
+	}
+
+	t, err := s.ParseMove(move)
+	if err != nil {
+		return nil, comment, score, scored
+	}
+	return t, comment, score, scored
+}
+
+// Return a score in centipawns standing for a mate in n moves (negative if
+// the player to move is getting mated)
+func mateCentipawns(n int) int {
+	if n < 0 {
+		return Centipawns(-(Mate + 2 * n))
+	}
+	return Centipawns(Mate - 2 * n + 1)
+}
+
+// Return a mate in n moves as a PGN comment gives it
+func mateText(n int) string {
+	if n < 0 {
+		return fmt.Sprintf("-M%d", -n)
+	}
+	return fmt.Sprintf("+M%d", n)
+}
+
+// Tell the engine to stop searching and move now, and read (for a while)
+// until it does
+func (e *ExternalEngine) stop() {
+	if e.Protocol == UCI {
+		e.send("stop")
+		e.readUntil("bestmove", engineMoveGrace, nil)
+		return
+	}
+
+	moved := false
+	e.send("?")
+	e.readUntil("", engineMoveGrace, func(fields []string) {
+		moved = fields[0] == "move" || fields[0] == "resign"
+	}, func() bool { return moved })
+}
+
+// Close() asks the engine to quit, and kills it if it doesn't.
+func (e *ExternalEngine) Close() error {
+	e.send("quit")
+	e.in.Close()
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- e.cmd.Wait()
+	}()
+	select {
+	case err := <-exited:
+		return err
+	case <-time.After(engineStartTimeout):
+		return e.cmd.Process.Kill()
+	}
+}
+
+// Send a line to the engine
+func (e *ExternalEngine) send(line string) {
+	PrintLog("\t\t\tENGINE " + e.Label + " <- " + line + "\n")
+	fmt.Fprintln(e.in, line)
+}
+
+// Read lines from the engine, passing each (split into fields) to each(),
+// until one starting with the given word, or until one of the optional
+// done() functions returns true, or until the timeout
+func (e *ExternalEngine) readUntil(word string, timeout time.Duration, each func([]string),
+				   done ...func() bool) error {
+	deadline := time.After(timeout)
+
+	for {
+		select {
+		case line, ok := <-e.lines:
+			if !ok {
+				return io.EOF
+			}
+			PrintLog("\t\t\tENGINE " + e.Label + " -> " + line + "\n")
+
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+			if each != nil {
+				each(fields)
+			}
+			if fields[0] == word {
+				return nil
+			}
+			for _, d := range done {
+				if d() {
+					return nil
+				}
+			}
+		case <-deadline:
+			return errEngineTimeout
+		}
+	}
+}
+
+// GameMoves() returns the position a game started from (following s's
+// predecessors back) and the moves since, in coordinate notation.
+func GameMoves(s *State) (*State, []string) {
+	var states []*State
+	for t := s; t != nil; t = t.GetPredecessor() {
+		states = append([]*State{t}, states...)
+	}
+
+	moves := make([]string, len(states) - 1)
+	for i := range moves {
+		moves[i] = MoveString(states[i], states[i + 1], Coordinate)
+	}
+	return states[0], moves
+}
+
+// ParseProtocol() reads the name of a protocol, "uci" or "xboard".
+func ParseProtocol(name string) (IOMode, error) {
+	switch strings.ToLower(name) {
+	case "uci":
+		return UCI, nil
+	case "xboard", "winboard", "cecp":
+		return Xboard, nil
+	}
+	return TUI, errors.New("unknown protocol: " + name)
+}
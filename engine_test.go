@@ -0,0 +1,240 @@
+// Copyright 2013 Chad Williamson.
+
+// This file is part of Turgenev, a chess program.
+
+// Turgenev is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Turgenev is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License along
+// with Turgenev. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// With $TURGENEV_FAKE_ENGINE set to "uci" or "xboard", the test binary is
+// a fake engine speaking that protocol instead, which the tests start as an
+// external engine. It answers each "go" with the first legal move, after
+// some thinking output to be parsed.
+const fakeEngineVar = "TURGENEV_FAKE_ENGINE"
+
+func TestMain(m *testing.M) {
+	switch os.Getenv(fakeEngineVar) {
+	case "uci":
+		fakeUCI()
+		os.Exit(0)
+	case "xboard":
+		fakeXboard()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// Play a UCI engine on stdin and stdout. The info lines check that depth
+// is read at the end of a line and that "string" ends the parsing.
+func fakeUCI() {
+	s := InitialState()
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "uci":
+			fmt.Println("id name Fake UCI")
+			fmt.Println("uciok")
+		case "isready":
+			fmt.Println("readyok")
+		case "position":
+			s = fakePosition(fields[1:])
+		case "go":
+			move := fakeMove(s)
+			fmt.Println("info depth 3")
+			fmt.Println("info score cp 25 nodes 100 pv " + move)
+			fmt.Println("info string depth 9 score cp 999")
+			fmt.Println("info depth 3 score")
+			fmt.Println("bestmove " + move)
+		case "quit":
+			return
+		}
+	}
+}
+
+// Play an xboard engine on stdin and stdout. It asks for "usermove", so
+// moves sent without it are ignored.
+func fakeXboard() {
+	s, usermove := InitialState(), false
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "protover":
+			fmt.Println(`feature myname="Fake Xboard 1.0" setboard=1`)
+			fmt.Println("feature usermove=1 done=1")
+		case "accepted":
+			if len(fields) > 1 && fields[1] == "usermove" {
+				usermove = true
+			}
+		case "new":
+			s = InitialState()
+		case "setboard":
+			s, _ = StateFromFEN(strings.Join(fields[1:], " "))
+		case "usermove":
+			if len(fields) > 1 && usermove {
+				s, _ = s.ParseMove(fields[1])
+			}
+		case "go":
+			move := fakeMove(s)
+			fmt.Println("3 25 10 100 " + move)
+			fmt.Println("move " + move)
+			s, _ = s.ParseMove(move)
+		case "quit":
+			return
+		}
+	}
+}
+
+// Return the position a UCI "position" command's arguments describe
+func fakePosition(args []string) *State {
+	s := InitialState()
+	i := 1
+	if len(args) > 0 && args[0] == "fen" {
+		for i < len(args) && args[i] != "moves" {
+			i++
+		}
+		s, _ = StateFromFEN(strings.Join(args[1:i], " "))
+	}
+	if i < len(args) && args[i] == "moves" {
+		for _, move := range args[i + 1:] {
+			s, _ = s.ParseMove(move)
+		}
+	}
+	return s
+}
+
+// Return the first legal move in s, which the fake engines always play
+func fakeMove(s *State) string {
+	return MoveString(s, s.LegalSuccessors().Front().Value.(*State), Coordinate)
+}
+
+// Start the test binary as a fake engine speaking the given protocol
+func startFakeEngine(t *testing.T, protocol IOMode) *ExternalEngine {
+	name := "uci"
+	if protocol == Xboard {
+		name = "xboard"
+	}
+	t.Setenv(fakeEngineVar, name)
+
+	e, err := StartEngine(os.Args[0], protocol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		e.Close()
+	})
+	return e
+}
+
+func TestXboardFeatures(t *testing.T) {
+	for _, test := range []struct {
+		args string
+		want [][2]string
+	}{
+		{`myname="Some Engine 1.0" usermove=1 done=0`,
+		 [][2]string{{"myname", "Some Engine 1.0"}, {"usermove", "1"}, {"done", "0"}}},
+		{`  san=0   variants="normal,wildcastle"  `,
+		 [][2]string{{"san", "0"}, {"variants", "normal,wildcastle"}}},
+		{`myname="" done=1`, [][2]string{{"myname", ""}, {"done", "1"}}},
+		{`myname="Unfinished`, [][2]string{{"myname", `"Unfinished`}}},
+		{`done=1 stray`, [][2]string{{"done", "1"}}},
+		{``, nil},
+	} {
+		if got := xboardFeatures(test.args); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("xboardFeatures(%q) = %q, want %q", test.args, got, test.want)
+		}
+	}
+}
+
+func TestStartEngine(t *testing.T) {
+	if _, err := StartEngine("  ", UCI); err == nil {
+		t.Error("StartEngine() accepted an empty command")
+	}
+	if _, err := StartEngine(os.Args[0], TUI); err == nil {
+		t.Error("StartEngine() accepted the TUI protocol")
+	}
+
+	if e := startFakeEngine(t, UCI); e.Name() != "Fake UCI" {
+		t.Errorf("UCI engine's name is %q", e.Name())
+	}
+
+	e := startFakeEngine(t, Xboard)
+	if e.Name() != "Fake Xboard 1.0" {
+		t.Errorf("xboard engine's name is %q", e.Name())
+	}
+	if !e.usermove {
+		t.Error("xboard engine's usermove feature wasn't taken up")
+	}
+}
+
+func TestEngineMove(t *testing.T) {
+	s, err := InitialState().ParseMove("e4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err = s.ParseMove("c5"); err != nil {
+		t.Fatal(err)
+	}
+	from := mustFEN(t, "r3k2r/p1ppqpb1/bn2pnp1/3PN3/1p2P3/2N2Q1p/PPPBBPPP/R3K2R w KQkq - 0 1")
+
+	for _, protocol := range []IOMode{UCI, Xboard} {
+		e := startFakeEngine(t, protocol)
+		e.Depth = 3
+		for _, position := range []*State{s, from} {
+			want := position.LegalSuccessors().Front().Value.(*State)
+			c, comment, score, scored := e.Move(position)
+			if c == nil || c.FEN() != want.FEN() {
+				t.Errorf("%s: %s played %v, want %s", position.FEN(), e.Name(),
+					 c, want.FEN())
+				continue
+			}
+			if !scored || score != 25 || !strings.HasPrefix(comment, "+0.25/3 ") {
+				t.Errorf("%s: %s's score read as %d, %v (%q)", position.FEN(),
+					 e.Name(), score, scored, comment)
+			}
+		}
+	}
+}
+
+func TestEnginePlayGame(t *testing.T) {
+	white, black := startFakeEngine(t, UCI), startFakeEngine(t, Xboard)
+	white.Depth, black.Depth = 1, 1
+
+	g := PlayGame(white, black, InitialState(), Adjudication{MaxPlies: 10})
+	if g.Result != "1/2-1/2" || g.Tags["Termination"] != "adjudication" {
+		t.Errorf("game ended %s (%s)", g.Result, g.Tags["Termination"])
+	}
+	if len(g.Moves) != 10 {
+		t.Errorf("game has %d plies, want 10: %v", len(g.Moves), g.Moves)
+	}
+	if g.Tags["White"] != "Fake UCI" || g.Tags["Black"] != "Fake Xboard 1.0" {
+		t.Errorf("players are %q and %q", g.Tags["White"], g.Tags["Black"])
+	}
+}
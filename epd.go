@@ -0,0 +1,289 @@
+// Copyright 2013 Chad Williamson.
+
+// This file is part of Turgenev, a chess program.
+
+// Turgenev is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Turgenev is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License along
+// with Turgenev. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An EPDPosition is a line of an EPD file: a position (the first four
+// fields of its FEN) and its operations, by opcode. The operations a test
+// suite uses are
+//
+//	bm	the best moves (in SAN), one of which solves the position
+//	am	moves to avoid, none of which may be played
+//	dm	a mate in this many moves must be found
+//	id	the position's name
+//
+// and, to override the limits the suite is run with for a position,
+//
+//	acd	the depth to search to
+//	acs	the seconds to search for
+type EPDPosition struct {
+	FEN string
+	Ops map[string][]string
+}
+
+// ReadEPDFile() reads all of the positions in an EPD file, skipping blank
+// lines and lines starting with '#'.
+func ReadEPDFile(path string) ([]*EPDPosition, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var positions []*EPDPosition
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		p, err := ParseEPD(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, i + 1, err)
+		}
+		positions = append(positions, p)
+	}
+
+	return positions, nil
+}
+
+// ParseEPD() reads a line of EPD. Operands may be quoted to hold spaces or
+// semicolons.
+func ParseEPD(line string) (*EPDPosition, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 4 {
+		return nil, errors.New("incomplete EPD: " + line)
+	}
+
+	p := &EPDPosition{FEN: strings.Join(fields[:4], " "), Ops: make(map[string][]string)}
+	rest := line
+	for i := 0; i < 4; i++ {
+		rest = strings.TrimSpace(rest)
+		rest = rest[strings.IndexAny(rest + " ", " \t"):]
+	}
+
+	var op []string
+	token, quoted, inToken := "", false, false
+	for _, r := range rest + ";" {
+		switch {
+		case r == '"':
+			quoted, inToken = !quoted, true
+		case quoted || (r != ' ' && r != '\t' && r != ';'):
+			token += string(r)
+			inToken = true
+		default:
+			if inToken {
+				op = append(op, token)
+				token, inToken = "", false
+			}
+			if r == ';' && len(op) > 0 {
+				p.Ops[op[0]] = op[1:]
+				op = nil
+			}
+		}
+	}
+	if quoted {
+		return nil, errors.New("unterminated string: " + line)
+	}
+
+	return p, nil
+}
+
+// ID() returns the position's id operation, or "" if it has none.
+func (p *EPDPosition) ID() string {
+	if id := p.Ops["id"]; len(id) > 0 {
+		return id[0]
+	}
+	return ""
+}
+
+// An EPDResult is how the search did on a position of a test suite.
+type EPDResult struct {
+	ID string `json:"id"`
+	FEN string `json:"fen"`
+	Move string `json:"move"`
+	Best []string `json:"bm,omitempty"`
+	Avoid []string `json:"am,omitempty"`
+	Mate int `json:"dm,omitempty"`
+	Solved bool `json:"solved"`
+	Score string `json:"score"`
+	Depth int `json:"depth"`
+	Nodes int `json:"nodes"`
+	Seconds float64 `json:"seconds"`
+}
+
+// An EPDReport is a whole run of a test suite, as written with -json.
+type EPDReport struct {
+	Positions []EPDResult `json:"positions"`
+	Solved int `json:"solved"`
+	Total int `json:"total"`
+	Seconds float64 `json:"seconds"`
+}
+
+// RunEPD() searches a position to the given depth, or for the given time if
+// it isn't zero (the position's acd and acs operations taking precedence),
+// and checks the move against its bm, am and dm operations.
+func RunEPD(p *EPDPosition, depth int, limit time.Duration) (EPDResult, error) {
+	r := EPDResult{ID: p.ID(), FEN: p.FEN, Best: p.Ops["bm"], Avoid: p.Ops["am"]}
+
+	s, err := StateFromFEN(p.FEN)
+	if err != nil {
+		return r, err
+	}
+	if acd := p.Ops["acd"]; len(acd) > 0 {
+		if depth, err = strconv.Atoi(acd[0]); err != nil || depth < 1 || depth > MaxPly {
+			return r, errors.New("bad acd: " + acd[0])
+		}
+		limit = 0
+	}
+	if acs := p.Ops["acs"]; len(acs) > 0 {
+		seconds, err := strconv.ParseFloat(acs[0], 64)
+		if err != nil {
+			return r, errors.New("bad acs: " + acs[0])
+		}
+		limit = time.Duration(seconds * float64(time.Second))
+	}
+	if dm := p.Ops["dm"]; len(dm) > 0 {
+		if r.Mate, err = strconv.Atoi(dm[0]); err != nil {
+			return r, errors.New("bad dm: " + dm[0])
+		}
+	}
+
+	// The moves to find and to avoid, as positions
+	best, avoid := make(map[string]bool), make(map[string]bool)
+	for _, ops := range []struct {
+		moves []string
+		set map[string]bool
+	}{{r.Best, best}, {r.Avoid, avoid}} {
+		for _, move := range ops.moves {
+			t, err := s.ParseMove(move)
+			if err != nil {
+				return r, fmt.Errorf("%s (%v)", move, err)
+			}
+			ops.set[t.FEN()] = true
+		}
+	}
+
+	sc := NewSearch(DefaultEvaluator)
+	if limit > 0 {
+		sc.Deadline = time.Now().Add(limit)
+		if p.Ops["acd"] == nil {
+			depth = MaxPly / 4
+		}
+	}
+	c := NegamaxST(sc, s, depth)
+	if c == nil {
+		return r, errors.New("no legal moves")
+	}
+
+	r.Move = MoveString(s, c, Algebraic)
+	r.Score = ScoreString(sc.LastScore, UCI)
+	r.Depth, r.Nodes, r.Seconds = sc.LastDepth, sc.Nodes, sc.WallTime.Seconds()
+	r.Solved = (len(best) == 0 || best[c.FEN()]) && !avoid[c.FEN()] &&
+		   (r.Mate == 0 || (IsMateScore(sc.LastScore) && MateDistance(sc.LastScore) == r.Mate))
+
+	return r, nil
+}
+
+// EPD() is the "epd" subcommand, which runs the test suites in the EPD files
+// named on the command line, printing each position's result and the
+// number solved (or, with -json, a report for comparing builds).
+func EPD(args []string) int {
+	flags := flag.NewFlagSet("epd", flag.ExitOnError)
+	depth := flags.Int("depth", 4, "search depth for each position")
+	limit := flags.Duration("time", 0, "search time for each position (instead of a depth)")
+	asJSON := flags.Bool("json", false, "write the results as JSON")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "epd: no EPD files given")
+		return 2
+	}
+
+	var report EPDReport
+	for _, path := range flags.Args() {
+		positions, err := ReadEPDFile(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "epd:", err)
+			return 1
+		}
+
+		for _, p := range positions {
+			r, err := RunEPD(p, *depth, *limit)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "epd: %s: %s: %v\n", path, p.FEN, err)
+				continue
+			}
+
+			report.Positions = append(report.Positions, r)
+			report.Total++
+			report.Seconds += r.Seconds
+			if r.Solved {
+				report.Solved++
+			}
+			if *asJSON {
+				continue
+			}
+
+			status, expected := "failed", ""
+			if r.Solved {
+				status = "solved"
+			}
+			if len(r.Best) > 0 {
+				expected += " bm " + strings.Join(r.Best, " ")
+			}
+			if len(r.Avoid) > 0 {
+				expected += " am " + strings.Join(r.Avoid, " ")
+			}
+			if r.Mate > 0 {
+				expected += fmt.Sprintf(" dm %d", r.Mate)
+			}
+			fmt.Printf("%4d %-16s %-8s %-6s%-20s %-10s depth %-3d%8.2f s\n",
+				   report.Total, r.ID, r.Move, status, expected, r.Score,
+				   r.Depth, r.Seconds)
+		}
+	}
+
+	if *asJSON {
+		out, err := json.MarshalIndent(report, "", "\t")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "epd:", err)
+			return 1
+		}
+		fmt.Printf("%s\n", out)
+		return 0
+	}
+
+	percent := 0.0
+	if report.Total > 0 {
+		percent = 100 * float64(report.Solved) / float64(report.Total)
+	}
+	fmt.Printf("\nSolved %d of %d (%.1f%%) in %.2f s\n", report.Solved, report.Total,
+		   percent, report.Seconds)
+
+	return 0
+}
@@ -0,0 +1,296 @@
+// Copyright 2013 Chad Williamson.
+
+// This file is part of Turgenev, a chess program.
+
+// Turgenev is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Turgenev is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License along
+// with Turgenev. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+// The game phase is measured by the non-pawn material left on the board,
+// with knights and bishops counting 1, rooks 2 and queens 4. It starts at
+// MaxPhase and falls toward 0 as the endgame approaches.
+const MaxPhase = 24
+
+// Phase() returns the game phase of the state, between 0 (a bare endgame)
+// and MaxPhase (all pieces on the board).
+func (s *State) Phase() int {
+	phase := 0
+
+	for i := 0; i < 8; i++ {
+		for j := 0; j < 8; j++ {
+			switch (s.GetPiece(i, j)) {
+			case Knight, Bishop:
+				phase += 1
+			case Rook:
+				phase += 2
+			case Queen:
+				phase += 4
+			}
+		}
+	}
+
+	if phase > MaxPhase {
+		phase = MaxPhase
+	}
+	return phase
+}
+
+// An Evaluator is the evaluation function with a set of weights, and the
+// pawn hash table that caches what they make of pawn structures. Searches
+// with different weights (the players of a match, say) each need their own.
+type Evaluator struct {
+	Params *EvalParams
+	pawns *PawnTable
+}
+
+// DefaultEvaluator evaluates with Params, the weights that -weights and the
+// engine options set.
+var DefaultEvaluator = &Evaluator{&Params, NewPawnTable(PawnTableSize)}
+
+// NewEvaluator() returns an evaluator with its own copy of the given
+// weights, and a pawn table the size of the default evaluator's.
+func NewEvaluator(p EvalParams) *Evaluator {
+	return &Evaluator{&p, NewPawnTable(len(DefaultEvaluator.pawns.entries))}
+}
+
+// An EvalTerm is one pluggable element of the evaluation function. Its
+// Score function returns the middlegame and endgame scores of the given
+// player with the evaluator's weights, which are blended according to the
+// game phase.
+type EvalTerm struct {
+	Name string
+	Score func(s *State, e *Evaluator, player Color) (mg, eg int)
+}
+
+// EvalTerms are the positional elements of the evaluation function, which
+// Value() adds to MaterialAdvantage().
+var EvalTerms = []EvalTerm{
+	{"bishop pair", (*State).BishopPairScore},
+	{"piece-square", (*State).PieceSquareScore},
+	{"pawn structure", (*State).PawnStructureScore},
+	{"king safety", (*State).KingSafetyScore},
+	{"activity", (*State).ActivityScore},
+}
+
+// PositionalAdvantage() is one element of the evaluation function which
+// returns the sum of the EvalTerms for the player to move, less those of
+// the opponent.
+func (s *State) PositionalAdvantage(e *Evaluator) int {
+	player, mg, eg := s.GetToMove(), 0, 0
+
+	for _, term := range EvalTerms {
+		m, n := term.Score(s, e, player)
+		enemyM, enemyN := term.Score(s, e, Opponent(player))
+		mg, eg = mg + m - enemyM, eg + n - enemyN
+	}
+
+	return Taper(mg, eg, s.Phase())
+}
+
+// TraceTerm is one line of an evaluation trace: a term's scores for each
+// side, and their difference from White's point of view, in centipawns.
+type TraceTerm struct {
+	Name string `json:"name"`
+	WhiteMg int `json:"white_mg"`
+	WhiteEg int `json:"white_eg"`
+	BlackMg int `json:"black_mg"`
+	BlackEg int `json:"black_eg"`
+	White int `json:"white"`
+	Black int `json:"black"`
+	Total int `json:"total"`
+}
+
+// TraceCapture is a capture available to the player to move, with its
+// static exchange evaluation in centipawns.
+type TraceCapture struct {
+	Move string `json:"move"`
+	SEE int `json:"see"`
+}
+
+// Trace is a breakdown of the evaluation of a state by term, along with
+// the exchanges pending on the board.
+type Trace struct {
+	Phase int `json:"phase"`
+	Terms []TraceTerm `json:"terms"`
+	Total int `json:"total"`
+	Captures []TraceCapture `json:"captures"`
+}
+
+// EvalTrace() explains Value() with the default evaluator term by term.
+// Each side's score for a term is tapered by the phase, and the total is
+// Value() from White's point of view.
+func (s *State) EvalTrace() Trace {
+	ev, phase := DefaultEvaluator, s.Phase()
+	t := Trace{Phase: phase}
+
+	terms := append([]EvalTerm{{"material", (*State).MaterialScore}},
+			EvalTerms...)
+	for _, term := range terms {
+		wm, we := term.Score(s, ev, White)
+		bm, be := term.Score(s, ev, Black)
+		white, black := Taper(wm, we, phase), Taper(bm, be, phase)
+		t.Terms = append(t.Terms, TraceTerm{term.Name,
+			Centipawns(wm), Centipawns(we), Centipawns(bm), Centipawns(be),
+			Centipawns(white), Centipawns(black),
+			Centipawns(white - black)})
+	}
+
+	t.Total = s.Value(ev)
+	if s.GetToMove() == Black {
+		t.Total = -t.Total
+	}
+	t.Total = Centipawns(t.Total)
+
+	captures := s.Captures()
+	for e := captures.Front(); e != nil; e = e.Next() {
+		child := e.Value.(*State)
+		t.Captures = append(t.Captures, TraceCapture{
+			MoveString(s, child, Algebraic), Centipawns(s.MoveSEE(ev, child))})
+	}
+
+	return t
+}
+
+// Taper() blends a middlegame and an endgame score according to the phase.
+func Taper(mg, eg, phase int) int {
+	return (mg * phase + eg * (MaxPhase - phase)) / MaxPhase
+}
+
+// PieceSquareScore() returns the sum of the middlegame and endgame
+// piece-square table entries for the given player's pieces.
+func (s *State) PieceSquareScore(e *Evaluator, player Color) (mg, eg int) {
+	for i := 0; i < 8; i++ {
+		for j := 0; j < 8; j++ {
+			if s.GetColor(i, j) == player {
+				piece, index := s.GetPiece(i, j), PieceSquareIndex(player, i, j)
+				mg += e.Params.MgPieceSquare[piece][index]
+				eg += e.Params.EgPieceSquare[piece][index]
+			}
+		}
+	}
+
+	return
+}
+
+// PieceSquareIndex() maps square (row, col) to an index into the
+// piece-square tables, which are written from White's point of view with
+// the eighth rank first (so that they look like the board).
+func PieceSquareIndex(player Color, row, col int) int {
+	if player == White {
+		return ((7 - row) << 3) + col
+	}
+	return (row << 3) + col
+}
+
+// Default piece-square tables (see DefaultParams()), in the same units as
+// MaterialValue(): they're the usual centipawn tables scaled to a pawn of
+// 0100.
+var mgPawnSquare = [64]int{
+	  0,   0,   0,   0,   0,   0,   0,   0,
+	 32,  32,  32,  32,  32,  32,  32,  32,
+	  6,   6,  13,  19,  19,  13,   6,   6,
+	  3,   3,   6,  16,  16,   6,   3,   3,
+	  0,   0,   0,  13,  13,   0,   0,   0,
+	  3,  -3,  -6,   0,   0,  -6,  -3,   3,
+	  3,   6,   6, -13, -13,   6,   6,   3,
+	  0,   0,   0,   0,   0,   0,   0,   0,
+}
+
+var egPawnSquare = [64]int{
+	  0,   0,   0,   0,   0,   0,   0,   0,
+	 51,  51,  51,  51,  51,  51,  51,  51,
+	 32,  32,  32,  32,  32,  32,  32,  32,
+	 19,  19,  19,  19,  19,  19,  19,  19,
+	 10,  10,  10,  10,  10,  10,  10,  10,
+	  3,   3,   3,   3,   3,   3,   3,   3,
+	  0,   0,   0,   0,   0,   0,   0,   0,
+	  0,   0,   0,   0,   0,   0,   0,   0,
+}
+
+var knightSquare = [64]int{
+	-32, -26, -19, -19, -19, -19, -26, -32,
+	-26, -13,   0,   0,   0,   0, -13, -26,
+	-19,   0,   6,  10,  10,   6,   0, -19,
+	-19,   3,  10,  13,  13,  10,   3, -19,
+	-19,   0,  10,  13,  13,  10,   0, -19,
+	-19,   3,   6,  10,  10,   6,   3, -19,
+	-26, -13,   0,   3,   3,   0, -13, -26,
+	-32, -26, -19, -19, -19, -19, -26, -32,
+}
+
+var bishopSquare = [64]int{
+	-13,  -6,  -6,  -6,  -6,  -6,  -6, -13,
+	 -6,   0,   0,   0,   0,   0,   0,  -6,
+	 -6,   0,   3,   6,   6,   3,   0,  -6,
+	 -6,   3,   3,   6,   6,   3,   3,  -6,
+	 -6,   0,   6,   6,   6,   6,   0,  -6,
+	 -6,   6,   6,   6,   6,   6,   6,  -6,
+	 -6,   3,   0,   0,   0,   0,   3,  -6,
+	-13,  -6,  -6,  -6,  -6,  -6,  -6, -13,
+}
+
+var mgRookSquare = [64]int{
+	  0,   0,   0,   0,   0,   0,   0,   0,
+	  3,   6,   6,   6,   6,   6,   6,   3,
+	 -3,   0,   0,   0,   0,   0,   0,  -3,
+	 -3,   0,   0,   0,   0,   0,   0,  -3,
+	 -3,   0,   0,   0,   0,   0,   0,  -3,
+	 -3,   0,   0,   0,   0,   0,   0,  -3,
+	 -3,   0,   0,   0,   0,   0,   0,  -3,
+	  0,   0,   0,   3,   3,   0,   0,   0,
+}
+
+var egRookSquare = [64]int{
+	  3,   3,   3,   3,   3,   3,   3,   3,
+	  6,   6,   6,   6,   6,   6,   6,   6,
+	  0,   0,   0,   0,   0,   0,   0,   0,
+	  0,   0,   0,   0,   0,   0,   0,   0,
+	  0,   0,   0,   0,   0,   0,   0,   0,
+	  0,   0,   0,   0,   0,   0,   0,   0,
+	  0,   0,   0,   0,   0,   0,   0,   0,
+	  0,   0,   0,   0,   0,   0,   0,   0,
+}
+
+var queenSquare = [64]int{
+	-13,  -6,  -6,  -3,  -3,  -6,  -6, -13,
+	 -6,   0,   0,   0,   0,   0,   0,  -6,
+	 -6,   0,   3,   3,   3,   3,   0,  -6,
+	 -3,   0,   3,   3,   3,   3,   0,  -3,
+	  0,   0,   3,   3,   3,   3,   0,  -3,
+	 -6,   3,   3,   3,   3,   3,   0,  -6,
+	 -6,   0,   3,   0,   0,   0,   0,  -6,
+	-13,  -6,  -6,  -3,  -3,  -6,  -6, -13,
+}
+
+var mgKingSquare = [64]int{
+	-19, -26, -26, -32, -32, -26, -26, -19,
+	-19, -26, -26, -32, -32, -26, -26, -19,
+	-19, -26, -26, -32, -32, -26, -26, -19,
+	-19, -26, -26, -32, -32, -26, -26, -19,
+	-13, -19, -19, -26, -26, -19, -19, -13,
+	 -6, -13, -13, -13, -13, -13, -13,  -6,
+	 13,  13,   0,   0,   0,   0,  13,  13,
+	 13,  19,   6,   0,   0,   6,  19,  13,
+}
+
+var egKingSquare = [64]int{
+	-32, -26, -19, -13, -13, -19, -26, -32,
+	-19, -13,  -6,   0,   0,  -6, -13, -19,
+	-19,  -6,  13,  19,  19,  13,  -6, -19,
+	-19,  -6,  19,  26,  26,  19,  -6, -19,
+	-19,  -6,  19,  26,  26,  19,  -6, -19,
+	-19,  -6,  13,  19,  19,  13,  -6, -19,
+	-19, -19,   0,   0,   0,   0, -19, -19,
+	-32, -19, -19, -19, -19, -19, -19, -32,
+}
@@ -0,0 +1,261 @@
+// Copyright 2013 Chad Williamson.
+
+// This file is part of Turgenev, a chess program.
+
+// Turgenev is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Turgenev is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License along
+// with Turgenev. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const InitialFEN = "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1"
+
+// StateFromFEN() returns the state described by a position in Forsyth-Edwards
+// Notation. The move counters may be omitted; of the two, only the halfmove
+// clock is used.
+//
+// Since a State has no castling flags of its own, kings and rooks that may
+// not castle are marked as moved. An en passant target is represented the
+// way a real game would leave it: the pawn that just advanced two squares
+// is marked as moved, and the state gets a predecessor with the pawn back
+// where it came from.
+func StateFromFEN(fen string) (*State, error) {
+	fields := strings.Fields(fen)
+	if len(fields) < 4 {
+		return nil, errors.New("incomplete FEN: " + fen)
+	}
+
+	s := CreateState()
+	ranks := strings.Split(fields[0], "/")
+	if len(ranks) != 8 {
+		return nil, errors.New("bad FEN placement: " + fields[0])
+	}
+	for i, rank := range ranks {
+		row, col := 7 - i, 0
+		for _, r := range rank {
+			if r >= '1' && r <= '8' {
+				col += int(r - '0')
+				continue
+			}
+			piece := PieceFromRune(r)
+			if piece == Empty || col > 7 {
+				return nil, errors.New("bad FEN placement: " + fields[0])
+			}
+			s.SetPiece(row, col, piece)
+			if unicode.IsUpper(r) {
+				s.SetColor(row, col, White)
+			} else {
+				s.SetColor(row, col, Black)
+			}
+			col++
+		}
+		if col != 8 {
+			return nil, errors.New("bad FEN placement: " + fields[0])
+		}
+	}
+
+	switch fields[1] {
+	case "w":
+		s.SetToMove(White)
+	case "b":
+		s.SetToMove(Black)
+	default:
+		return nil, errors.New("bad FEN player to move: " + fields[1])
+	}
+
+	// Everything that matters for castling starts out moved, and the
+	// castling rights then clear the flags they need.
+	for _, row := range []int{0, 7} {
+		for _, col := range []int{0, 4, 7} {
+			if s.GetPiece(row, col) != Empty {
+				s.SetMoved(row, col, true)
+			}
+		}
+	}
+	for i := 0; i < 8; i++ {
+		for j := 0; j < 8; j++ {
+			if s.GetPiece(i, j) == King && !(j == 4 && (i == 0 || i == 7)) {
+				s.SetMoved(i, j, true)
+			}
+		}
+	}
+	if fields[2] != "-" {
+		for _, r := range fields[2] {
+			row, col := 0, 7
+			switch r {
+			case 'K':
+			case 'Q':
+				col = 0
+			case 'k':
+				row = 7
+			case 'q':
+				row, col = 7, 0
+			default:
+				return nil, errors.New("bad FEN castling: " + fields[2])
+			}
+			s.SetMoved(row, 4, false)
+			s.SetMoved(row, col, false)
+		}
+	}
+
+	if fields[3] != "-" {
+		if len(fields[3]) != 2 {
+			return nil, errors.New("bad FEN en passant: " + fields[3])
+		}
+		col, row := int(fields[3][0] - 'a'), int(fields[3][1] - '1')
+		pawnRow, fromRow := 3, 1
+		if s.GetToMove() == White {
+			pawnRow, fromRow = 4, 6
+		}
+		if col < 0 || col > 7 || (row != 2 && row != 5) ||
+		   s.GetPiece(pawnRow, col) != Pawn {
+			return nil, errors.New("bad FEN en passant: " + fields[3])
+		}
+		s.SetMoved(pawnRow, col, true)
+
+		p := CopyState(s)
+		p.setSquare(fromRow, col, s.getSquare(pawnRow, col))
+		p.SetMoved(fromRow, col, false)
+		p.ClearSquare(pawnRow, col)
+		p.SetToMove(Opponent(s.GetToMove()))
+		s.SetPredecessor(p)
+	}
+
+	if len(fields) > 4 {
+		n, err := strconv.Atoi(fields[4])
+		if err != nil || n < 0 {
+			return nil, errors.New("bad FEN halfmove clock: " + fields[4])
+		}
+		s.halfmoves = n
+	}
+
+	return s, nil
+}
+
+// FEN() returns the position in Forsyth-Edwards Notation. Turgenev doesn't
+// keep track of the move number, so it's always 1.
+func (s *State) FEN() string {
+	var b strings.Builder
+
+	for i := 7; i >= 0; i-- {
+		empty := 0
+		for j := 0; j < 8; j++ {
+			if s.GetPiece(i, j) == Empty {
+				empty++
+				continue
+			}
+			if empty > 0 {
+				b.WriteRune(rune('0' + empty))
+				empty = 0
+			}
+			b.WriteRune(s.GetRune(i, j))
+		}
+		if empty > 0 {
+			b.WriteRune(rune('0' + empty))
+		}
+		if i > 0 {
+			b.WriteRune('/')
+		}
+	}
+
+	if s.GetToMove() == White {
+		b.WriteString(" w ")
+	} else {
+		b.WriteString(" b ")
+	}
+
+	castling := s.CastlingRights()
+	if castling == "" {
+		castling = "-"
+	}
+	b.WriteString(castling + " ")
+
+	if row, col, ok := s.EnPassantTarget(); ok {
+		b.WriteRune(File(col))
+		b.WriteRune(Rank(row))
+	} else {
+		b.WriteString("-")
+	}
+
+	b.WriteString(" " + strconv.Itoa(s.HalfmoveClock()) + " 1")
+	return b.String()
+}
+
+// CastlingRights() returns the castling rights in FEN's "KQkq" form. (Only
+// whether the king and rook have moved is considered, not whether castling
+// is currently possible.)
+func (s *State) CastlingRights() string {
+	rights := ""
+
+	for _, side := range []struct {
+		player Color
+		row, col int
+		r string
+	}{{White, 0, 7, "K"}, {White, 0, 0, "Q"}, {Black, 7, 7, "k"}, {Black, 7, 0, "q"}} {
+		if s.GetPiece(side.row, 4) == King && s.GetColor(side.row, 4) == side.player &&
+		   !s.GetMoved(side.row, 4) && s.unmovedRook(side.row, side.col, side.player) {
+			rights += side.r
+		}
+	}
+
+	return rights
+}
+
+// EnPassantTarget() returns the square behind a pawn that has just advanced
+// two squares, if there is one.
+func (s *State) EnPassantTarget() (row, col int, ok bool) {
+	p := s.GetPredecessor()
+	if p == nil {
+		return
+	}
+
+	pawnRow, behind := 3, 2
+	if s.GetToMove() == White {
+		pawnRow, behind = 4, 5
+	}
+	for j := 0; j < 8; j++ {
+		if s.GetPiece(pawnRow, j) == Pawn && s.GetColor(pawnRow, j) != s.GetToMove() &&
+		   s.GetMoved(pawnRow, j) && p.GetPiece(pawnRow, j) == Empty {
+			return behind, j, true
+		}
+	}
+
+	return
+}
+
+// PieceFromRune() returns the piece represented by the given letter (of
+// either case), or Empty if there isn't one.
+func PieceFromRune(r rune) Piece {
+	switch (unicode.ToUpper(r)) {
+	case 'P':
+		return Pawn
+	case 'N':
+		return Knight
+	case 'B':
+		return Bishop
+	case 'R':
+		return Rook
+	case 'Q':
+		return Queen
+	case 'K':
+		return King
+	}
+
+	return Empty
+}
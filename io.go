@@ -18,9 +18,13 @@
 package main
 
 import (
+	"bufio"
 	"container/list"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"strings"
 	"time"
 	"unicode"
 )
@@ -37,11 +41,18 @@ type IOMode byte
 const (
 	TUI IOMode = iota
 	Xboard
+	UCI
 )
 
 var (
 	Mode IOMode = TUI
 	Orientation Color = White
+
+	// Whether to print thinking output (xboard's "post" command)
+	Post bool = false
+
+	// All input is read through here, whatever the mode
+	Input *bufio.Reader = bufio.NewReader(os.Stdin)
 )
 
 // This Action thing is a hack for telling the game loop to pass control
@@ -51,23 +62,39 @@ type Action byte
 const (
         MakeMove Action = iota
         SetCompWhite
+        StartUCI
+        SetPosition
+        EndGame
 )
 
 func Prompt(s *State) (next *State, a Action) {
 	moveMap, choice := StringsToStates(s), "FIRST"
+	var args []string
 
 	for moveMap[choice] == nil {
-		if choice != "FIRST" && Mode == Xboard {
-			if IsMove(choice) {
-				fmt.Printf("Illegal move: " + choice + "\n")
-				PrintLog("\t\t\tOUTPUT: Illegal move: " + choice + "\n")
-			}
-		}
-
 		switch choice {
 		case "xboard":
 			Mode = Xboard
 			fmt.Printf("\n")
+		case "uci":
+			Mode = UCI
+			next, a = nil, StartUCI
+			return
+		case "protover":
+			PrintFeatures()
+		case "option":
+			if len(args) > 0 {
+				XboardOption(strings.Join(args, " "))
+			}
+		case "egtpath":
+			// "egtpath syzygy PATH"
+			if len(args) > 1 && args[0] == "syzygy" {
+				XboardOption(SyzygyPathOption + "=" + strings.Join(args[1:], " "))
+			}
+		case "post":
+			Post = true
+		case "nopost":
+			Post = false
 		case "tui":
 			Mode = TUI
 			fmt.Printf("\nSwitched to TUI mode...\n\n")
@@ -80,42 +107,216 @@ func Prompt(s *State) (next *State, a Action) {
 			PrintState(s, Orientation)
 		case "moves":
 			if Mode == TUI { PrintPossibleMoves(s) }
+		case "load", "next", "prev", "goto":
+			if t, err := ReplayCommand(choice, args); err != nil {
+				fmt.Printf("\n%v\n\n", err)
+			} else {
+				fmt.Printf("\n%s\n", CurrentReplay)
+				next, a = t, SetPosition
+				return
+			}
+		case "pgn":
+			fmt.Printf("\n%s\n", CurrentGame)
+		case "eval":
+			PrintEval(s, len(args) > 0 && args[0] == "json")
 		case "white":
 			fallthrough
 		case "switch":
 			next, a = nil, SetCompWhite
 			return
+		case "result":
+			// "result RESULT {COMMENT}", from xboard when the game
+			// is over.
+			if len(args) > 0 {
+				switch args[0] {
+				case "1-0", "0-1", "1/2-1/2":
+					CurrentGame.SetResult(args[0])
+				}
+			}
+			next, a = nil, EndGame
+			return
 		case "quit":
 			if Mode == TUI { fmt.Printf("\nBye!\n\n") }
-			os.Exit(0)
+			next, a = nil, EndGame
+			return
 		default:
-			if choice != "FIRST" && Mode == TUI {
+			if choice == "FIRST" {
+				break
+			}
+			input := strings.Join(append([]string{choice}, args...), " ")
+			t, err := s.ParseMove(input)
+			if t != nil {
+				next, a = t, MakeMove
+				return
+			}
+
+			switch {
+			case Mode == Xboard && (err != ErrNotAMove || IsMove(choice)):
+				out := fmt.Sprintf("Illegal move (%v): %s\n", err, input)
+				fmt.Printf("%s", out)
+				PrintLog("\t\t\tOUTPUT: " + out)
+			case Mode == TUI && err != ErrNotAMove:
+				fmt.Printf("\nIllegal move (%v): %s\n\n", err, input)
+			case Mode == TUI:
 				fmt.Printf("\nI didn't understand that. Type 'help' " +
 					   "for a list of things I understand.\n\n")
 			}
 		}
 
 		if Mode == TUI { fmt.Printf("Your move: ") }
-		fmt.Scanf("%s", &choice)
-		PrintLog("INPUT: " + choice + "\n")
+		choice, args = ReadCommand()
 	}
 
 	next, a = moveMap[choice], MakeMove
 	return
 }
 
+// ReadCommand() reads a line of input and splits it into a command and its
+// arguments. The end of the input is treated as "quit".
+func ReadCommand() (command string, args []string) {
+	line, err := Input.ReadString('\n')
+	if err != nil && line == "" {
+		return "quit", nil
+	}
+	PrintLog("INPUT: " + line)
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", nil
+	}
+	return fields[0], fields[1:]
+}
+
 func StringsToStates(start *State) map[string]*State {
 	successors := start.LegalSuccessors()
 	m := make(map[string]*State)
 
 	for e := successors.Front(); e != nil; e = e.Next() {
+		san := MoveString(start, e.Value.(*State), Algebraic)
 		m[MoveString(start, e.Value.(*State), Coordinate)] = e.Value.(*State)
-		m[MoveString(start, e.Value.(*State), Algebraic)] = e.Value.(*State)
+		m[san] = e.Value.(*State)
+		m[strings.TrimRight(san, "+#")] = e.Value.(*State)
 	}
 
 	return m
 }
 
+// ErrNotAMove is ParseMove()'s error for input that doesn't look like a
+// move at all.
+var ErrNotAMove = errors.New("not a move")
+
+// ParseMove() returns the legal successor of s described by a move in any
+// of the usual notations: SAN ("Nbd7", "e8=Q", "exd6 e.p."), long algebraic
+// ("Ng1-f3") or coordinate notation as xboard and UCI use it ("e7e8q").
+// Castling may be written with O's or zeros, and promotion letters and
+// other piece letters (but 'b', which could be a file) in either case. If
+// the move is illegal or ambiguous, the error says so (briefly, to go in
+// "Illegal move (...)").
+func (s *State) ParseMove(input string) (*State, error) {
+	move := strings.TrimSpace(input)
+	for _, suffix := range []string{"e.p.", "ep"} {
+		n := len(move) - len(suffix)
+		if n > 0 && strings.EqualFold(move[n:], suffix) &&
+		   (move[n - 1] == ' ' || unicode.IsDigit(rune(move[n - 1]))) {
+			move = strings.TrimSpace(move[:n])
+			break
+		}
+	}
+	move = strings.TrimRight(move, "+#!?")
+	if move == "" || strings.ContainsAny(move, " \t") {
+		return nil, ErrNotAMove
+	}
+
+	var matches []*State
+	switch castling := strings.ToUpper(strings.Replace(move, "0", "O", -1)); castling {
+	case "O-O", "OO":
+		matches = stateList(s.castlingSuccessor(6))
+	case "O-O-O", "OOO":
+		matches = stateList(s.castlingSuccessor(2))
+	default:
+		var ok bool
+		if matches, ok = s.coordinateMatches(move); !ok {
+			matches, ok = s.SANMatches(normalizeSAN(move))
+		}
+		if !ok {
+			return nil, ErrNotAMove
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil, errors.New("illegal")
+	case 1:
+		return matches[0], nil
+	}
+
+	var names []string
+	for _, t := range matches {
+		names = append(names, MoveString(s, t, Algebraic))
+	}
+	return nil, errors.New("ambiguous: could be " + strings.Join(names, " or "))
+}
+
+// Return the legal successors of s matching a move in coordinate notation
+// ("e2e4", "e2-e4", "e7e8q", "e7e8=Q"), or false if it isn't one. A move to
+// the last rank without a promotion piece matches all four promotions.
+func (s *State) coordinateMatches(move string) ([]*State, bool) {
+	if len(move) > 2 && (move[2] == '-' || move[2] == 'x') {
+		move = move[:2] + move[3:]
+	}
+	if len(move) == 6 && move[4] == '=' {
+		move = move[:4] + move[5:]
+	}
+	if len(move) != 4 && len(move) != 5 {
+		return nil, false
+	}
+	for i, r := range move[:4] {
+		if (i % 2 == 0 && (r < 'a' || r > 'h')) || (i % 2 == 1 && (r < '1' || r > '8')) {
+			return nil, false
+		}
+	}
+
+	promotion := Piece(Empty)
+	if len(move) == 5 {
+		promotion = PieceFromRune(unicode.ToUpper(rune(move[4])))
+		if promotion == Empty || promotion == Pawn || promotion == King {
+			return nil, false
+		}
+	}
+
+	c1, r1, c2, r2 := int(move[0] - 'a'), int(move[1] - '1'), int(move[2] - 'a'), int(move[3] - '1')
+	var matches []*State
+	for e := s.LegalSuccessors().Front(); e != nil; e = e.Next() {
+		t := e.Value.(*State)
+		tr1, tc1, tr2, tc2 := MoveSquares(s, t)
+		if tr1 != r1 || tc1 != c1 || tr2 != r2 || tc2 != c2 {
+			continue
+		}
+		if promotion != Empty && t.GetPiece(r2, c2) != promotion {
+			continue
+		}
+		matches = append(matches, t)
+	}
+
+	return matches, true
+}
+
+// Return a SAN move with a lowercase piece letter or promotion letter made
+// uppercase. A leading 'b' is always read as a file.
+func normalizeSAN(move string) string {
+	b := []byte(move)
+
+	if strings.ContainsRune("nrqk", rune(b[0])) {
+		b[0] = byte(unicode.ToUpper(rune(b[0])))
+	}
+	if n := len(b); n > 2 && strings.ContainsRune("nbrq", rune(b[n - 1])) &&
+	   (b[n - 2] == '=' || b[n - 2] == '1' || b[n - 2] == '8') {
+		b[n - 1] = byte(unicode.ToUpper(rune(b[n - 1])))
+	}
+
+	return string(b)
+}
+
 func PrintResults(final *State) {
 	if final.InCheck() {
 		if final.GetToMove() == Black {
@@ -143,17 +344,141 @@ func PrintResults(final *State) {
 	}
 }
 
+// PrintDraw() announces a draw for the given reason, when it isn't
+// stalemate.
+func PrintDraw(reason string) {
+	if Mode == TUI {
+		fmt.Printf("\nDraw by %s.\n\n", reason)
+	} else {
+		fmt.Printf("result 1/2-1/2 {%s}\n", reason)
+	}
+	PrintLog("\t\t\tOUTPUT: result 1/2-1/2 {" + reason + "}\n")
+}
+
+// PrintThinking() reports the result of a search in xboard's "ply score
+// time nodes pv" format.
+func PrintThinking(s, choice *State, sc *SearchContext) {
+	out := fmt.Sprintf("%d %s %d %d %s\n", sc.LastDepth,
+			   ScoreString(sc.LastScore, Xboard),
+			   sc.WallTime.Nanoseconds() / 10000000, sc.Nodes,
+			   MoveString(s, choice, Algebraic))
+	fmt.Printf("%s", out)
+	PrintLog("\t\t\tOUTPUT: " + out)
+}
+
+// ScoreString() formats a search score for the given IO mode. UCI wants
+// "cp N" or "mate N" (in moves, negative when getting mated), while xboard
+// reports mates as 100000 + N (or -100000 - N) in place of centipawns.
+func ScoreString(score int, mode IOMode) string {
+	if mode == UCI {
+		if IsMateScore(score) {
+			return fmt.Sprintf("mate %d", MateDistance(score))
+		}
+		return fmt.Sprintf("cp %d", Centipawns(score))
+	}
+
+	if IsMateScore(score) {
+		if n := MateDistance(score); n > 0 {
+			return fmt.Sprintf("%d", 100000 + n)
+		} else {
+			return fmt.Sprintf("%d", -100000 + n)
+		}
+	}
+	return fmt.Sprintf("%d", Centipawns(score))
+}
+
+// PrintFeatures() answers xboard's "protover" command, advertising the
+// engine options.
+func PrintFeatures() {
+	out := "feature myname=\"Turgenev\" done=0\n"
+	for _, w := range OptionWeights() {
+		out += fmt.Sprintf("feature option=\"%s -spin %d %d %d\"\n", w.Name,
+				   *w.Value, OptionMin(w.Name), optionLimit)
+	}
+	out += "feature option=\"" + WeightsFileOption + " -file \"\n"
+	out += fmt.Sprintf("feature option=\"%s -check %d\"\n", OwnBookOption, boolInt(OwnBook))
+	out += "feature option=\"" + BookFileOption + " -file \"\n"
+	out += fmt.Sprintf("feature option=\"%s -spin %d 0 %d\"\n", BookDepthOption,
+			   BookDepth, MaxPly)
+	out += fmt.Sprintf("feature option=\"%s -check %d\"\n", BookBestOption, boolInt(BookBest))
+	out += fmt.Sprintf("feature option=\"%s -check %d\"\n", Syzygy50MoveRuleOption,
+			   boolInt(Syzygy50MoveRule))
+	out += "feature option=\"" + EndgamePathOption + " -path \"\n"
+	out += "feature egt=\"syzygy\"\n"
+	out += "feature done=1\n"
+
+	fmt.Printf("%s", out)
+	PrintLog("\t\t\tOUTPUT: " + out)
+}
+
+// boolInt() returns 1 for true and 0 for false, as xboard writes checkboxes.
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// XboardOption() handles xboard's "option NAME=VALUE" command.
+func XboardOption(arg string) {
+	i := strings.Index(arg, "=")
+	if i < 0 {
+		return
+	}
+
+	if err := SetOption(arg[:i], arg[i + 1:]); err != nil {
+		fmt.Printf("Error (%v): option\n", err)
+		PrintLog(fmt.Sprintf("\t\t\tOUTPUT: Error (%v): option\n", err))
+	}
+}
+
+// PrintEval() prints the evaluation trace of s as a table or as JSON.
+func PrintEval(s *State, asJSON bool) {
+	t := s.EvalTrace()
+
+	if asJSON {
+		out, err := json.Marshal(t)
+		if err != nil { panic(err) }
+		fmt.Printf("%s\n", out)
+		return
+	}
+
+	fmt.Printf("\n%-16s%8s%8s%8s\n", "term", "white", "black", "total")
+	for _, term := range t.Terms {
+		fmt.Printf("%-16s%8d%8d%8d\n", term.Name, term.White, term.Black,
+			   term.Total)
+	}
+	fmt.Printf("\n%-16s%24d\n", "total (phase " + fmt.Sprint(t.Phase) + ")",
+		   t.Total)
+	fmt.Printf("(in centipawns, from White's point of view)\n\n")
+
+	if len(t.Captures) > 0 {
+		fmt.Printf("Captures (by static exchange evaluation):\n")
+		for _, c := range t.Captures {
+			fmt.Printf("\t%-8s%+d\n", c.Move, c.SEE)
+		}
+		fmt.Printf("\n")
+	}
+}
+
 func PrintHelp() {
 	fmt.Printf("\n\tTURGENEV COMMANDS\n\n")
 
 	fmt.Printf("help\t\tPrint this menu\n")
 	fmt.Printf("moves\t\tPrint the possible moves (in coordinate notation)\n")
+	fmt.Printf("eval [json]\tExplain the evaluation of the position\n")
+	fmt.Printf("pgn\t\tPrint the game so far in PGN\n")
+	fmt.Printf("load FILE [N]\tReplay the Nth game of a PGN file\n")
+	fmt.Printf("next [N]\tGo N plies forward in the game being replayed\n")
+	fmt.Printf("prev [N]\tGo N plies back in the game being replayed\n")
+	fmt.Printf("goto PLY\tGo to a ply of the game being replayed (or start or end)\n")
 	fmt.Printf("reprint\t\tPrint the board again\n")
 	fmt.Printf("rotate\t\tView the board from the other side\n")
 	fmt.Printf("switch\t\tTrade places with the computer\n\n")
 
 	fmt.Printf("tui\t\tSwitch to human TUI IO mode\n")
-	fmt.Printf("xboard\t\tSwitch to xboard IO mode\n\n")
+	fmt.Printf("xboard\t\tSwitch to xboard IO mode\n")
+	fmt.Printf("uci\t\tSwitch to UCI IO mode\n\n")
 
 	fmt.Printf("quit\t\tExit the program\n\n")
 }
@@ -196,6 +521,10 @@ func PrintPossibleMoves(s *State) {
 }
 
 func PrintLog(str string) {
+	if Log == "" {
+		return
+	}
+
 	fd, err := os.OpenFile(Log, os.O_RDWR | os.O_APPEND, 0666)
 	if err != nil {
 		fd, err = os.Create(Log)
@@ -222,7 +551,11 @@ func MoveList(s *State, mr MoveRepresentation) *list.List {
 	return moves
 }
 
+// MoveString() writes the move from s1 to s2 in coordinate notation or in
+// Standard Algebraic Notation, as the PGN standard defines it (with the
+// check or checkmate mark).
 func MoveString(s1, s2 *State, mr MoveRepresentation) string {
+	move := ""
 	differences := 0
 	for i := 0; i < 8; i++ {
 		for j := 0; j < 8; j++ {
@@ -234,14 +567,21 @@ func MoveString(s1, s2 *State, mr MoveRepresentation) string {
 
 	switch (differences) {
 	case 2:
-		return RegularMoveString(s1, s2, mr)
+		move = RegularMoveString(s1, s2, mr)
 	case 3:
-		return EnPassantMoveString(s1, s2, mr)
+		move = EnPassantMoveString(s1, s2, mr)
 	case 4:
-		return CastleMoveString(s1, s2, mr)
+		move = CastleMoveString(s1, s2, mr)
 	}
 
-	return ""
+	if mr == Algebraic && move != "" && s2.InCheck() {
+		if s2.HasLegalMove() {
+			move += "+"
+		} else {
+			move += "#"
+		}
+	}
+	return move
 }
 
 func RegularMoveString(s1, s2 *State, mr MoveRepresentation) string {
@@ -274,9 +614,7 @@ func RegularMoveString(s1, s2 *State, mr MoveRepresentation) string {
 
 	if s1.GetPiece(r1, c1) != Pawn {
 		move = fmt.Sprintf("%c%s", unicode.ToUpper(s1.GetRune(r1, c1)),
-				   move)
-		// Possibly redundant:
-		//move = fmt.Sprintf("%s%c%c", move, File(c1), Rank(r1))
+				   s1.disambiguation(r1, c1, r2, c2))
 	}
 
 	if s1.GetPiece(r2, c2) != Empty {
@@ -289,12 +627,45 @@ func RegularMoveString(s1, s2 *State, mr MoveRepresentation) string {
 	move = fmt.Sprintf("%s%c%c", move, File(c2), Rank(r2))
 
 	if s1.GetPiece(r1, c1) == Pawn && (r2 == 7 || r2 == 0) {
-		move = fmt.Sprintf("%s%c", move, s2.GetRune(r2, c2))
+		move = fmt.Sprintf("%s=%c", move, unicode.ToUpper(s2.GetRune(r2, c2)))
 	}
 
 	return move
 }
 
+// Return what SAN adds to the letter of the piece moving from (r1, c1) to
+// (r2, c2) to tell its move from those of other pieces of the same kind
+// that could go there: the file it leaves from if that's enough, or else
+// the rank if that's enough, or else both.
+func (s *State) disambiguation(r1, c1, r2, c2 int) string {
+	others, sameFile, sameRank := false, false, false
+
+	for e := s.LegalSuccessors().Front(); e != nil; e = e.Next() {
+		t := e.Value.(*State)
+		if s.castled(t) {
+			continue
+		}
+		tr1, tc1, tr2, tc2 := MoveSquares(s, t)
+		if tr2 != r2 || tc2 != c2 || (tr1 == r1 && tc1 == c1) ||
+		   s.GetPiece(tr1, tc1) != s.GetPiece(r1, c1) {
+			continue
+		}
+		others = true
+		sameFile = sameFile || tc1 == c1
+		sameRank = sameRank || tr1 == r1
+	}
+
+	switch {
+	case !others:
+		return ""
+	case !sameFile:
+		return string(File(c1))
+	case !sameRank:
+		return string(Rank(r1))
+	}
+	return string(File(c1)) + string(Rank(r1))
+}
+
 func EnPassantMoveString(s1, s2 *State, mr MoveRepresentation) string {
 	var r1, c1, r2, c2 int
 
@@ -0,0 +1,82 @@
+// Copyright 2013 Chad Williamson.
+
+// This file is part of Turgenev, a chess program.
+
+// Turgenev is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Turgenev is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License along
+// with Turgenev. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// Starting points for the random games: the initial position, one full of
+// castling, en passant and pins, and one where pawns promote with and
+// without captures.
+var roundTripFENs = []string{
+	InitialFEN,
+	"r3k2r/p1ppqpb1/bn2pnp1/3PN3/1p2P3/2N2Q1p/PPPBBPPP/R3K2R w KQkq - 0 1",
+	"n1n5/PPPk4/8/8/8/8/4Kppp/5N1N b - - 0 1",
+}
+
+// TestMoveRoundTrip plays random games (the same ones every time), and
+// checks that each move played is read back as itself from both its SAN
+// and its coordinate notation.
+func TestMoveRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, fen := range roundTripFENs {
+		for game := 0; game < 8; game++ {
+			s := mustFEN(t, fen)
+			for ply := 0; ply < 80; ply++ {
+				successors := s.LegalSuccessors()
+				if successors.Len() == 0 {
+					break
+				}
+				n := r.Intn(successors.Len())
+				e := successors.Front()
+				for ; n > 0; n-- {
+					e = e.Next()
+				}
+				c := e.Value.(*State)
+				checkRoundTrip(t, s, c)
+				s = c
+			}
+		}
+	}
+}
+
+func checkRoundTrip(t *testing.T, s, c *State) {
+	t.Helper()
+	want := c.FEN()
+
+	san := MoveString(s, c, Algebraic)
+	mate := c.InCheck() && !c.HasLegalMove()
+	if mate != strings.HasSuffix(san, "#") ||
+	   (c.InCheck() && !mate) != strings.HasSuffix(san, "+") {
+		t.Fatalf("%s: %s has the wrong check mark", s.FEN(), san)
+	}
+	if got := s.SANSuccessor(san); got == nil || got.FEN() != want {
+		t.Fatalf("%s: SANSuccessor(%q) doesn't give %s", s.FEN(), san, want)
+	}
+	if got, err := s.ParseMove(san); err != nil || got.FEN() != want {
+		t.Fatalf("%s: ParseMove(%q) doesn't give %s (%v)", s.FEN(), san, want, err)
+	}
+
+	coord := MoveString(s, c, Coordinate)
+	if got, err := s.ParseMove(coord); err != nil || got.FEN() != want {
+		t.Fatalf("%s: ParseMove(%q) doesn't give %s (%v)", s.FEN(), coord, want, err)
+	}
+}
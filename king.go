@@ -0,0 +1,133 @@
+// Copyright 2013 Chad Williamson.
+
+// This file is part of Turgenev, a chess program.
+
+// Turgenev is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Turgenev is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License along
+// with Turgenev. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+// KingSafetyScore() returns the middlegame and endgame king safety scores
+// for the given player. The endgame score is always zero, so that the
+// terms fade away as material comes off the board.
+func (s *State) KingSafetyScore(e *Evaluator, player Color) (mg, eg int) {
+	row, col, found := s.FindKing(player)
+	if !found {
+		return
+	}
+
+	mg += s.pawnShield(e.Params, player, row, col)
+	mg += s.kingFiles(e.Params, player, col)
+	mg += s.kingAttackers(e.Params, player, row, col)
+
+	return
+}
+
+// FindKing() returns the square of the given player's king.
+func (s *State) FindKing(player Color) (row, col int, found bool) {
+	for i := 0; i < 8; i++ {
+		for j := 0; j < 8; j++ {
+			if s.GetPiece(i, j) == King && s.GetColor(i, j) == player {
+				return i, j, true
+			}
+		}
+	}
+
+	return
+}
+
+// Score the friendly pawns in front of the king (the shield) and the enemy
+// pawns advancing toward it (the storm), on the king's file and its
+// neighbors.
+func (s *State) pawnShield(p *EvalParams, player Color, row, col int) int {
+	value, forward := 0, 1
+	if player == Black {
+		forward = -1
+	}
+
+	for j := col - 1; j <= col + 1; j++ {
+		if j < 0 || j > 7 {
+			continue
+		}
+
+		shield := 0
+		for k := 1; k <= 2; k++ {
+			i := row + k * forward
+			if i >= 0 && i < 8 && s.GetPiece(i, j) == Pawn &&
+			   s.GetColor(i, j) == player {
+				shield = k
+				break
+			}
+		}
+		value += p.ShieldPawn[shield]
+
+		for i := 0; i < 8; i++ {
+			if s.GetPiece(i, j) == Pawn && s.GetColor(i, j) == Opponent(player) {
+				value += p.StormPawn[RelativeRank(player, i)]
+			}
+		}
+	}
+
+	return value
+}
+
+// Penalize files next to the king without friendly pawns, and more so
+// those without any pawns at all.
+func (s *State) kingFiles(p *EvalParams, player Color, col int) int {
+	value := 0
+
+	for j := col - 1; j <= col + 1; j++ {
+		if j < 0 || j > 7 || s.pawnOnFile(player, j) {
+			continue
+		}
+		if s.pawnOnFile(Opponent(player), j) {
+			value += p.SemiOpenKingFile
+		} else {
+			value += p.OpenKingFile
+		}
+	}
+
+	return value
+}
+
+// Count attack units of the enemy pieces hitting the king zone (the king's
+// square and its neighbors) and penalize them on a rising scale. A single
+// attacker is rarely dangerous, so it costs nothing.
+func (s *State) kingAttackers(p *EvalParams, player Color, row, col int) int {
+	zone := squareBit(row, col)
+	for _, step := range kingSteps {
+		zone |= squareBit(row + step[0], col + step[1])
+	}
+
+	units, attackers := 0, 0
+	for i := 0; i < 8; i++ {
+		for j := 0; j < 8; j++ {
+			if s.GetColor(i, j) != Opponent(player) {
+				continue
+			}
+			hits := popCount(s.AttackSet(i, j) & zone)
+			if hits > 0 && p.AttackUnits[s.GetPiece(i, j)] > 0 {
+				units += p.AttackUnits[s.GetPiece(i, j)] * hits
+				attackers++
+			}
+		}
+	}
+
+	if attackers < 2 {
+		return 0
+	}
+	if units >= len(p.KingAttack) {
+		units = len(p.KingAttack) - 1
+	}
+	return -p.KingAttack[units]
+}
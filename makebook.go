@@ -0,0 +1,228 @@
+// Copyright 2013 Chad Williamson.
+
+// This file is part of Turgenev, a chess program.
+
+// Turgenev is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Turgenev is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License along
+// with Turgenev. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// MoveStats are what the book builder knows about a move in a position: how
+// often it was played and how it scored for the player making it, in half
+// points (2 for a win, 1 for a draw).
+type MoveStats struct {
+	Played int
+	Score int
+}
+
+// A BookBuilder accumulates move statistics per position (by Polyglot key
+// and move) from the games it's given.
+type BookBuilder struct {
+	Plies int
+	Stats map[uint64]map[uint16]*MoveStats
+}
+
+// NewBookBuilder() returns a builder that looks at the first plies plies of
+// each game (0 for all of them).
+func NewBookBuilder(plies int) *BookBuilder {
+	return &BookBuilder{plies, make(map[uint64]map[uint16]*MoveStats)}
+}
+
+// MakeBook() is the "makebook" subcommand. It reads the PGN files named on
+// the command line (and the .pgn files in any directories named there),
+// keeps the games that pass the result and rating filters and writes a
+// Polyglot book of the moves played in them. As in Polyglot's own book
+// maker, a move's weight is its score in half points, so moves that only
+// ever lost are left out.
+func MakeBook(args []string) int {
+	flags := flag.NewFlagSet("makebook", flag.ExitOnError)
+	out := flags.String("out", "book.bin", "file to write the book to")
+	plies := flags.Int("plies", 20, "only use this many plies of each game (0 for all)")
+	results := flags.String("results", "1-0,0-1,1/2-1/2", "comma-separated results of the games to use")
+	minElo := flags.Int("minelo", 0, "skip games unless both players are rated at least this")
+	minPlayed := flags.Int("mingames", 1, "leave out moves played in fewer games than this")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "makebook: no PGN files or directories given")
+		return 2
+	}
+
+	paths, err := PGNPaths(flags.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "makebook:", err)
+		return 1
+	}
+
+	allowed := make(map[string]bool)
+	for _, r := range strings.Split(*results, ",") {
+		allowed[strings.TrimSpace(r)] = true
+	}
+
+	b, read, used := NewBookBuilder(*plies), 0, 0
+	for _, path := range paths {
+		games, err := ReadPGNFile(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "makebook:", err)
+			return 1
+		}
+
+		for i, g := range games {
+			read++
+			if !allowed[g.Result] || !g.RatedAtLeast(*minElo) {
+				continue
+			}
+			if err := b.AddGame(g); err != nil {
+				fmt.Fprintf(os.Stderr, "makebook: %s: game %d: %v\n", path, i + 1, err)
+				continue
+			}
+			used++
+		}
+	}
+
+	book := b.Book(*minPlayed)
+	if err := book.Save(*out); err != nil {
+		fmt.Fprintln(os.Stderr, "makebook:", err)
+		return 1
+	}
+	fmt.Printf("Used %d of %d games from %d files: %d positions, %d entries written to %s\n",
+		   used, read, len(paths), len(b.Stats), len(book.Entries), *out)
+
+	return 0
+}
+
+// PGNPaths() expands the given paths into a list of PGN files: files are
+// taken as they are, and directories contribute the .pgn files directly
+// inside them.
+func PGNPaths(args []string) ([]string, error) {
+	var paths []string
+
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			paths = append(paths, arg)
+			continue
+		}
+
+		files, err := ioutil.ReadDir(arg)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			if !f.IsDir() && strings.EqualFold(filepath.Ext(f.Name()), ".pgn") {
+				paths = append(paths, filepath.Join(arg, f.Name()))
+			}
+		}
+	}
+
+	return paths, nil
+}
+
+// RatedAtLeast() returns true iff both players' WhiteElo and BlackElo tags
+// are at least elo. Missing ratings count as zero.
+func (g *PGNGame) RatedAtLeast(elo int) bool {
+	if elo <= 0 {
+		return true
+	}
+
+	for _, tag := range []string{"WhiteElo", "BlackElo"} {
+		rating, err := strconv.Atoi(g.Tags[tag])
+		if err != nil || rating < elo {
+			return false
+		}
+	}
+
+	return true
+}
+
+// AddGame() adds the moves of a game to the statistics. If the game has an
+// illegal move, the moves before it are still counted.
+func (b *BookBuilder) AddGame(g *PGNGame) error {
+	states, err := g.States()
+
+	for i := 0; i + 1 < len(states); i++ {
+		if b.Plies > 0 && i >= b.Plies {
+			break
+		}
+		s := states[i]
+		key, move := s.PolyglotKey(), s.BookMoveCode(states[i + 1])
+
+		moves := b.Stats[key]
+		if moves == nil {
+			moves = make(map[uint16]*MoveStats)
+			b.Stats[key] = moves
+		}
+		m := moves[move]
+		if m == nil {
+			m = new(MoveStats)
+			moves[move] = m
+		}
+
+		m.Played++
+		switch g.Result {
+		case "1/2-1/2":
+			m.Score++
+		case "1-0", "0-1":
+			if (g.Result == "1-0") == (s.GetToMove() == White) {
+				m.Score += 2
+			}
+		}
+	}
+
+	return err
+}
+
+// Book() returns the book made from the statistics, leaving out moves that
+// were played in fewer than minPlayed games or never scored. If a position's
+// scores don't fit in Polyglot's 16-bit weights, they're scaled down.
+func (b *BookBuilder) Book(minPlayed int) *Book {
+	book := new(Book)
+
+	for key, moves := range b.Stats {
+		max := 0
+		for _, m := range moves {
+			if m.Played >= minPlayed && m.Score > max {
+				max = m.Score
+			}
+		}
+
+		for move, m := range moves {
+			if m.Played < minPlayed || m.Score == 0 {
+				continue
+			}
+			weight := m.Score
+			if max > 0xFFFF {
+				weight = weight * 0xFFFF / max
+			}
+			if weight == 0 {
+				weight = 1
+			}
+			book.Entries = append(book.Entries, BookEntry{key, move, uint16(weight), 0})
+		}
+	}
+
+	return book
+}
@@ -0,0 +1,509 @@
+// Copyright 2013 Chad Williamson.
+
+// This file is part of Turgenev, a chess program.
+
+// Turgenev is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Turgenev is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License along
+// with Turgenev. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A MatchPlayer is one side of a match: something that chooses a move in a
+// position and, optionally, says what it thinks of it.
+type MatchPlayer interface {
+	Name() string
+
+	// Move() returns the chosen successor of s, a comment for the game
+	// record, and the score (in centipawns, for the player to move) if
+	// there is one.
+	Move(s *State) (next *State, comment string, score int, scored bool)
+}
+
+// An EngineConfig is a configuration of Turgenev itself for playing a
+// match: its evaluator (with its own weights) and how long it searches each
+// move. Any number of games can use it at once.
+type EngineConfig struct {
+	Label string
+	Eval *Evaluator
+	Depth int
+	MoveTime time.Duration
+}
+
+// Name() returns the configuration's name for the game record.
+func (e *EngineConfig) Name() string {
+	return e.Label
+}
+
+// Move() searches s with the configuration's weights and limits.
+func (e *EngineConfig) Move(s *State) (*State, string, int, bool) {
+	sc, depth := NewSearch(e.Eval), e.Depth
+	if e.MoveTime > 0 {
+		sc.Deadline = time.Now().Add(e.MoveTime)
+		if depth == 0 {
+			depth = MaxPly / 4
+		}
+	}
+	c := NegamaxST(sc, s, depth)
+
+	return c, SearchComment(sc), e.Eval.Centipawns(sc.LastScore), true
+}
+
+// Adjudication says when a game is decided before the end: after MaxPlies
+// plies it's a draw, and a player whose own score has been at most
+// -ResignScore centipawns for ResignMoves of its moves in a row has lost.
+// Zero turns either rule off.
+type Adjudication struct {
+	MaxPlies int
+	ResignScore int
+	ResignMoves int
+}
+
+// PlayGame() plays a game from start between two players, ending it at
+// checkmate, stalemate, threefold repetition, the fifty-move rule or
+// insufficient material, or by adjudication.
+func PlayGame(white, black MatchPlayer, start *State, adj Adjudication) *PGNGame {
+	g := NewPGNGame(start)
+	g.Tags["Event"], g.Tags["White"], g.Tags["Black"] = "Turgenev match", white.Name(), black.Name()
+
+	s, plies := start, 0
+	seen := map[string]int{positionKey(s): 1}
+	losing := make(map[Color]int)
+	result, termination := "*", "normal"
+
+	for result == "*" {
+		switch {
+		case !s.HasLegalMove():
+			result = s.GameResult()
+		case s.HalfmoveClock() >= 100, seen[positionKey(s)] >= 3, s.insufficientMaterial():
+			result = "1/2-1/2"
+		case adj.MaxPlies > 0 && plies >= adj.MaxPlies:
+			result, termination = "1/2-1/2", "adjudication"
+		}
+		if result != "*" {
+			break
+		}
+
+		player := white
+		if s.GetToMove() == Black {
+			player = black
+		}
+		c, comment, score, scored := player.Move(s)
+		if c == nil {
+			// A player that can't come up with a move forfeits.
+			result, termination = "1-0", "rules infraction"
+			if s.GetToMove() == White {
+				result = "0-1"
+			}
+			break
+		}
+		if !PGNComments {
+			comment = ""
+		}
+		g.AddMove(s, c, comment)
+
+		mover := s.GetToMove()
+		if scored && adj.ResignScore > 0 && score <= -adj.ResignScore {
+			losing[mover]++
+		} else {
+			losing[mover] = 0
+		}
+		if adj.ResignMoves > 0 && losing[mover] >= adj.ResignMoves {
+			result, termination = "1-0", "adjudication"
+			if mover == White {
+				result = "0-1"
+			}
+		}
+
+		s = c
+		plies++
+		seen[positionKey(s)]++
+	}
+
+	g.SetResult(result)
+	g.Tags["Termination"] = termination
+	return g
+}
+
+// Return the position part of s's FEN (without the move counters), which
+// identifies it for the repetition rule
+func positionKey(s *State) string {
+	fields := strings.Fields(s.FEN())
+	return strings.Join(fields[:4], " ")
+}
+
+// Return true iff neither side has enough material to mate: only kings and
+// at most a single knight or bishop
+func (s *State) insufficientMaterial() bool {
+	minors := 0
+	for sq := 0; sq < 64; sq++ {
+		switch Piece(s.board[sq] & pieceMask) {
+		case Pawn, Rook, Queen:
+			return false
+		case Knight, Bishop:
+			minors++
+		}
+	}
+	return minors <= 1
+}
+
+// A MatchScore counts the games of a match from the first player's point of
+// view.
+type MatchScore struct {
+	Wins, Losses, Draws int
+}
+
+// Games() returns the number of games counted.
+func (m MatchScore) Games() int {
+	return m.Wins + m.Losses + m.Draws
+}
+
+// Points() returns the first player's score (a point for a win and half a
+// point for a draw).
+func (m MatchScore) Points() float64 {
+	return float64(m.Wins) + float64(m.Draws) / 2
+}
+
+// Add() counts a game's result, given which color the first player had.
+// Unfinished games don't count.
+func (m *MatchScore) Add(result string, first Color) {
+	switch {
+	case result == "1/2-1/2":
+		m.Draws++
+	case result != "1-0" && result != "0-1":
+	case (result == "1-0") == (first == White):
+		m.Wins++
+	default:
+		m.Losses++
+	}
+}
+
+// Elo() returns the Elo difference the score suggests between the first
+// player and the second, with the margin of its 95% confidence interval.
+// A perfect or hopeless score gives an infinite difference, and a score
+// with no variance (all draws, say) an infinite margin, since it says
+// nothing about how sure the difference is.
+func (m MatchScore) Elo() (elo, margin float64) {
+	n := float64(m.Games())
+	if n == 0 {
+		return 0, math.Inf(1)
+	}
+
+	p := m.Points() / n
+	if p == 0 || p == 1 {
+		return eloFromScore(p), math.Inf(1)
+	}
+	variance := (float64(m.Wins) * (1 - p) * (1 - p) + float64(m.Losses) * p * p +
+		     float64(m.Draws) * (0.5 - p) * (0.5 - p)) / n
+	if variance == 0 {
+		return eloFromScore(p), math.Inf(1)
+	}
+	deviation := math.Sqrt(variance / n)
+
+	elo = eloFromScore(p)
+	margin = (eloFromScore(p + 1.96 * deviation) - eloFromScore(p - 1.96 * deviation)) / 2
+	return
+}
+
+// Return the Elo difference for which the expected score is p
+func eloFromScore(p float64) float64 {
+	switch {
+	case p <= 0:
+		return math.Inf(-1)
+	case p >= 1:
+		return math.Inf(1)
+	}
+	return -400 * math.Log10(1 / p - 1)
+}
+
+// String() summarizes the score, e.g. "12.5 - 7.5 (+10 -5 =5), Elo
+// difference 88.7 +/- 140.2".
+func (m MatchScore) String() string {
+	elo, margin := m.Elo()
+	return fmt.Sprintf("%g - %g (+%d -%d =%d), Elo difference %.1f +/- %.1f",
+			   m.Points(), float64(m.Games()) - m.Points(), m.Wins, m.Losses,
+			   m.Draws, elo, margin)
+}
+
+// ReadOpenings() reads the starting positions for a match: the final
+// positions of the games in a PGN file, or else the positions of an EPD
+// (or FEN) file, one per line.
+func ReadOpenings(path string) ([]*State, error) {
+	var openings []*State
+
+	if strings.EqualFold(filepath.Ext(path), ".pgn") {
+		games, err := ReadPGNFile(path)
+		if err != nil {
+			return nil, err
+		}
+		for i, g := range games {
+			states, err := g.States()
+			if err != nil {
+				return nil, fmt.Errorf("%s: game %d: %v", path, i + 1, err)
+			}
+			openings = append(openings, states[len(states) - 1])
+		}
+		return openings, nil
+	}
+
+	positions, err := ReadEPDFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range positions {
+		s, err := StateFromFEN(p.FEN)
+		if err != nil {
+			return nil, err
+		}
+		openings = append(openings, s)
+	}
+	return openings, nil
+}
+
+// PlayMatch() plays games between two players on the given number of
+// goroutines, the first player taking White in the even-numbered games
+// (counting from 0). Each opening is played twice, once with each color.
+// The games are reported as they finish; once report() returns true (or
+// the given number of games have started, if it isn't zero), no more are
+// started. The games are returned in order.
+func PlayMatch(first, second MatchPlayer, games, concurrency int, openings []*State,
+	       adj Adjudication, report func(i int, g *PGNGame) bool) []*PGNGame {
+	if len(openings) == 0 {
+		openings = []*State{InitialState()}
+	}
+
+	var played []*PGNGame
+	next, stop := make(chan int), make(chan bool)
+	var wg sync.WaitGroup
+	var reportLock sync.Mutex
+	stopped := false
+
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				white, black := first, second
+				if i % 2 == 1 {
+					white, black = second, first
+				}
+				g := PlayGame(white, black, openings[i / 2 % len(openings)], adj)
+				g.Tags["Round"] = fmt.Sprint(i + 1)
+
+				reportLock.Lock()
+				for len(played) <= i {
+					played = append(played, nil)
+				}
+				played[i] = g
+				if report(i, g) && !stopped {
+					stopped = true
+					close(stop)
+				}
+				reportLock.Unlock()
+			}
+		}()
+	}
+
+dispatch:
+	for i := 0; games == 0 || i < games; i++ {
+		select {
+		case next <- i:
+		case <-stop:
+			break dispatch
+		}
+	}
+	close(next)
+	wg.Wait()
+
+	return played
+}
+
+// MatchOptions are the flags shared by the subcommands that play matches
+// between two configurations of Turgenev.
+type MatchOptions struct {
+	depth int
+	moveTime time.Duration
+	depths [2]int
+	times [2]time.Duration
+	weights [2]string
+	engines, protocols [2]string
+	openings, out string
+	concurrency int
+	adj Adjudication
+}
+
+// Add the flags to set the options to a flag set
+func (m *MatchOptions) addFlags(flags *flag.FlagSet) {
+	flags.IntVar(&m.depth, "depth", 3, "search depth of both players")
+	flags.DurationVar(&m.moveTime, "time", 0, "search time per move of both players (instead of a depth)")
+	for i := range m.weights {
+		n := i + 1
+		flags.StringVar(&m.weights[i], fmt.Sprint("weights", n), "", fmt.Sprintf("evaluation weights of player %d", n))
+		flags.IntVar(&m.depths[i], fmt.Sprint("depth", n), 0, fmt.Sprintf("search depth of player %d (instead of -depth)", n))
+		flags.DurationVar(&m.times[i], fmt.Sprint("time", n), 0, fmt.Sprintf("search time per move of player %d (instead of -time)", n))
+		flags.StringVar(&m.engines[i], fmt.Sprint("engine", n), "", fmt.Sprintf("command to run an external engine as player %d", n))
+		flags.StringVar(&m.protocols[i], fmt.Sprint("protocol", n), "uci", fmt.Sprintf("protocol of player %d's engine (uci or xboard)", n))
+	}
+	flags.StringVar(&m.openings, "openings", "", "play from the positions in this EPD or PGN file")
+	flags.StringVar(&m.out, "pgn", "match.pgn", "file to write the games to (\"\" for none)")
+	flags.IntVar(&m.concurrency, "concurrency", Threads, "number of games to play at once")
+	flags.IntVar(&m.adj.MaxPlies, "maxplies", 400, "adjudicate a draw after this many plies (0 for never)")
+	flags.IntVar(&m.adj.ResignScore, "resign", 1000, "adjudicate a loss for a player whose score is this bad (centipawns, 0 for never)")
+	flags.IntVar(&m.adj.ResignMoves, "resignmoves", 4, "number of moves in a row the -resign score has to last")
+}
+
+// Return the players and openings the options describe, starting any
+// external engines (which close() stops). The games file (unless it's a
+// directory) is emptied, since games are appended to it.
+func (m *MatchOptions) setup() ([2]MatchPlayer, []*State, error) {
+	var players [2]MatchPlayer
+
+	if m.out != "" {
+		if info, err := os.Stat(m.out); err != nil || !info.IsDir() {
+			f, err := os.Create(m.out)
+			if err != nil {
+				return players, nil, err
+			}
+			f.Close()
+		}
+	}
+
+	for i := range players {
+		// A time limit replaces the depth, unless the player has its own.
+		d, t := m.depth, m.moveTime
+		if m.times[i] > 0 {
+			t = m.times[i]
+		}
+		if t > 0 {
+			d = 0
+		}
+		if m.depths[i] > 0 {
+			d = m.depths[i]
+		}
+
+		if m.engines[i] != "" {
+			protocol, err := ParseProtocol(m.protocols[i])
+			if err != nil {
+				m.close(players)
+				return players, nil, err
+			}
+			e, err := StartEngine(m.engines[i], protocol)
+			if err != nil {
+				m.close(players)
+				return players, nil, err
+			}
+			e.Depth, e.MoveTime = d, t
+			players[i] = e
+			continue
+		}
+
+		e := &EngineConfig{Label: fmt.Sprint("Turgenev ", i + 1),
+				   Eval: NewEvaluator(DefaultParams()), Depth: d, MoveTime: t}
+		if w := m.weights[i]; w != "" {
+			p, err := ReadParams(w)
+			if err != nil {
+				m.close(players)
+				return players, nil, err
+			}
+			e.Eval = NewEvaluator(p)
+			e.Label += " (" + strings.TrimSuffix(filepath.Base(w), filepath.Ext(w)) + ")"
+		}
+		players[i] = e
+	}
+
+	if m.openings == "" {
+		return players, nil, nil
+	}
+	openings, err := ReadOpenings(m.openings)
+	if err != nil {
+		m.close(players)
+	}
+	return players, openings, err
+}
+
+// Stop the external engines among the players
+func (m *MatchOptions) close(players [2]MatchPlayer) {
+	for _, p := range players {
+		if e, ok := p.(*ExternalEngine); ok {
+			e.Close()
+		}
+	}
+}
+
+// Save the games of a match, if there's a file for them
+func (m *MatchOptions) save(games []*PGNGame) error {
+	if m.out == "" {
+		return nil
+	}
+	for _, g := range games {
+		if err := g.Save(m.out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Match() is the "match" subcommand, which plays games between two
+// configurations of Turgenev (differing in their weights or in how long they
+// search) and reports the first one's score against the second. Either
+// player may be an external engine instead, so that, for example,
+// "-games 1 -engine2 CMD" plays a game against another engine.
+func Match(args []string) int {
+	var options MatchOptions
+	flags := flag.NewFlagSet("match", flag.ExitOnError)
+	games := flags.Int("games", 10, "number of games to play")
+	options.addFlags(flags)
+	flags.Parse(args)
+
+	players, openings, err := options.setup()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "match:", err)
+		return 1
+	}
+	defer options.close(players)
+
+	var score MatchScore
+	played := PlayMatch(players[0], players[1], *games, options.concurrency, openings,
+			    options.adj, func(i int, g *PGNGame) bool {
+		score.Add(g.Result, firstPlayerColor(i))
+		fmt.Printf("Game %d (%s vs %s): %s (%s) -- %s\n", i + 1, g.Tags["White"],
+			   g.Tags["Black"], g.Result, g.Tags["Termination"], score)
+		return false
+	})
+
+	fmt.Printf("\n%s vs %s: %s\n", players[0].Name(), players[1].Name(), score)
+	if err := options.save(played); err != nil {
+		fmt.Fprintln(os.Stderr, "match:", err)
+		return 1
+	}
+
+	return 0
+}
+
+// Return the color the first player has in game i of a match
+func firstPlayerColor(i int) Color {
+	if i % 2 == 1 {
+		return Black
+	}
+	return White
+}
+
@@ -0,0 +1,58 @@
+// Copyright 2013 Chad Williamson.
+
+// This file is part of Turgenev, a chess program.
+
+// Turgenev is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Turgenev is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License along
+// with Turgenev. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+)
+
+// A firstMovePlayer always plays the first legal move.
+type firstMovePlayer struct{}
+
+func (firstMovePlayer) Name() string {
+	return "First Move"
+}
+
+func (firstMovePlayer) Move(s *State) (*State, string, int, bool) {
+	return s.LegalSuccessors().Front().Value.(*State), "", 0, false
+}
+
+// The fifty-move rule counts the moves made before the starting position.
+func TestPlayGameFiftyMoves(t *testing.T) {
+	start := mustFEN(t, "4k3/8/8/8/8/8/8/R3K3 w - - 98 80")
+	g := PlayGame(firstMovePlayer{}, firstMovePlayer{}, start, Adjudication{})
+	if g.Result != "1/2-1/2" || len(g.Moves) != 2 {
+		t.Errorf("game drawn as %s after %d plies, want 2: %v", g.Result, len(g.Moves), g.Moves)
+	}
+}
+
+func TestMatchScoreAdd(t *testing.T) {
+	var m MatchScore
+	for _, game := range []struct {
+		result string
+		first Color
+	}{
+		{"1-0", White}, {"0-1", Black}, {"0-1", White}, {"1/2-1/2", Black},
+		{"*", White}, {"*", Black},
+	} {
+		m.Add(game.result, game.first)
+	}
+	if want := (MatchScore{Wins: 2, Losses: 1, Draws: 1}); m != want {
+		t.Errorf("score %v, want %v", m, want)
+	}
+}
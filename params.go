@@ -0,0 +1,258 @@
+// Copyright 2013 Chad Williamson.
+
+// This file is part of Turgenev, a chess program.
+
+// Turgenev is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Turgenev is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License along
+// with Turgenev. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strconv"
+)
+
+// EvalParams collects every weight of the evaluation function, in the same
+// units as MaterialValue() (a pawn is 0100). Weights named Mg and Eg are the
+// middlegame and endgame halves of a tapered term. Arrays indexed by rank
+// count from the owner's side of the board.
+type EvalParams struct {
+	// Material, indexed by Piece
+	PieceValue [7]int
+
+	// Piece-square tables, indexed by Piece and PieceSquareIndex()
+	MgPieceSquare, EgPieceSquare [7][64]int
+
+	// Pawn structure
+	MgDoubledPawn, EgDoubledPawn int
+	MgIsolatedPawn, EgIsolatedPawn int
+	MgBackwardPawn, EgBackwardPawn int
+	MgConnectedPawn, EgConnectedPawn int
+	MgPassedPawn, EgPassedPawn [8]int
+	EgFreePassedPawn [8]int
+
+	// King safety: ShieldPawn is indexed by how far the shield pawn is
+	// from the king (0 if missing), StormPawn by the storming pawn's rank
+	// from the defender's side and KingAttack by attack units.
+	ShieldPawn [3]int
+	StormPawn [8]int
+	SemiOpenKingFile, OpenKingFile int
+	AttackUnits [7]int
+	KingAttack [16]int
+
+	// Piece activity: mobility is scored per square beyond the typical
+	// number for a piece of that type (all indexed by Piece).
+	MgMobility, EgMobility, TypicalMobility [7]int
+	MgRookOpenFile, EgRookOpenFile int
+	MgRookSemiOpenFile, EgRookSemiOpenFile int
+	MgRookOnSeventh, EgRookOnSeventh int
+	MgKnightOutpost, EgKnightOutpost int
+
+	// The bishop pair bonus shrinks by BishopPairPawn for every pawn
+	// on the board.
+	MgBishopPair, EgBishopPair int
+	BishopPairPawn int
+}
+
+// The weights currently used by the evaluation function
+var Params EvalParams = DefaultParams()
+
+// DefaultParams() returns the built-in evaluation weights.
+func DefaultParams() EvalParams {
+	return EvalParams{
+		PieceValue: [7]int{0, 0100, 0300, 0300, 0500, 01100, 0},
+
+		MgPieceSquare: [7][64]int{{}, mgPawnSquare, knightSquare,
+			bishopSquare, mgRookSquare, queenSquare, mgKingSquare},
+		EgPieceSquare: [7][64]int{{}, egPawnSquare, knightSquare,
+			bishopSquare, egRookSquare, queenSquare, egKingSquare},
+
+		MgDoubledPawn: -10, EgDoubledPawn: -20,
+		MgIsolatedPawn: -10, EgIsolatedPawn: -15,
+		MgBackwardPawn: -8, EgBackwardPawn: -10,
+		MgConnectedPawn: 5, EgConnectedPawn: 8,
+		MgPassedPawn: [8]int{0, 5, 5, 10, 20, 35, 60, 0},
+		EgPassedPawn: [8]int{0, 10, 10, 20, 35, 60, 100, 0},
+		EgFreePassedPawn: [8]int{0, 0, 5, 10, 20, 35, 60, 0},
+
+		ShieldPawn: [3]int{-15, 10, 5},
+		StormPawn: [8]int{0, 0, -20, -10, -5, 0, 0, 0},
+		SemiOpenKingFile: -10, OpenKingFile: -15,
+		AttackUnits: [7]int{0, 0, 2, 2, 3, 5, 0},
+		KingAttack: [16]int{0, 0, 2, 5, 9, 14, 20, 27, 35, 44, 54,
+				    65, 77, 90, 104, 119},
+
+		MgMobility: [7]int{0, 0, 4, 5, 2, 1, 0},
+		EgMobility: [7]int{0, 0, 4, 5, 4, 2, 0},
+		TypicalMobility: [7]int{0, 0, 4, 6, 6, 12, 0},
+		MgRookOpenFile: 20, EgRookOpenFile: 10,
+		MgRookSemiOpenFile: 10, EgRookSemiOpenFile: 5,
+		MgRookOnSeventh: 20, EgRookOnSeventh: 30,
+		MgKnightOutpost: 15, EgKnightOutpost: 10,
+
+		MgBishopPair: 25, EgBishopPair: 45,
+		BishopPairPawn: 1,
+	}
+}
+
+// A Weight is a single evaluation weight, named after its field in
+// EvalParams followed by any array indices (e.g. "MgPassedPawn6").
+type Weight struct {
+	Name string
+	Value *int
+}
+
+// Weights() lists every weight in p, in field order.
+func (p *EvalParams) Weights() []Weight {
+	var weights []Weight
+
+	v := reflect.ValueOf(p).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		weights = appendWeights(weights, v.Type().Field(i).Name, v.Field(i))
+	}
+
+	return weights
+}
+
+// Append the weights held by v (an int or an array of them) to weights.
+func appendWeights(weights []Weight, name string, v reflect.Value) []Weight {
+	if v.Kind() == reflect.Int {
+		return append(weights, Weight{name, v.Addr().Interface().(*int)})
+	}
+
+	for i := 0; i < v.Len(); i++ {
+		weights = appendWeights(weights, name + strconv.Itoa(i), v.Index(i))
+	}
+	return weights
+}
+
+// LoadParams() reads evaluation weights from a JSON file whose keys are the
+// field names of EvalParams, and starts using them. Weights missing from
+// the file keep their default values.
+func LoadParams(path string) error {
+	p, err := ReadParams(path)
+	if err != nil {
+		return err
+	}
+
+	Params = p
+	ClearPawnTable()
+	return nil
+}
+
+// ReadParams() reads evaluation weights as LoadParams() does, without using
+// them.
+func ReadParams(path string) (EvalParams, error) {
+	p := DefaultParams()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return p, err
+	}
+	if err = json.Unmarshal(data, &p); err != nil {
+		return p, fmt.Errorf("%s: %v", path, err)
+	}
+	for piece := Pawn; piece <= Queen; piece++ {
+		if p.PieceValue[piece] < 1 {
+			return p, fmt.Errorf("%s: PieceValue%d must be positive",
+					     path, piece)
+		}
+	}
+
+	return p, nil
+}
+
+// SaveParams() writes the current evaluation weights to a JSON file that
+// LoadParams() can read back.
+func SaveParams(path string) error {
+	data, err := json.MarshalIndent(Params, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// Engine options (for UCI's "setoption" and xboard's "option") are the
+// scalar weights and the short arrays of weights, plus WeightsFile for
+// loading a whole set (including the piece-square tables) at once.
+const (
+	WeightsFileOption = "WeightsFile"
+	maxOptionArray = 16
+	optionLimit = 4096
+)
+
+// OptionMin() returns the least value allowed for the named weight option.
+// Piece values must stay positive, since scores are reported in fractions
+// of a pawn.
+func OptionMin(name string) int {
+	switch name {
+	case "PieceValue1", "PieceValue2", "PieceValue3", "PieceValue4",
+	     "PieceValue5":
+		return 1
+	}
+	return -optionLimit
+}
+
+// OptionWeights() returns the weights that are exposed as engine options.
+func OptionWeights() []Weight {
+	var weights []Weight
+
+	v := reflect.ValueOf(&Params).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		if f.Kind() == reflect.Int ||
+		   (f.Len() <= maxOptionArray && f.Index(0).Kind() == reflect.Int) {
+			weights = appendWeights(weights, v.Type().Field(i).Name, f)
+		}
+	}
+
+	return weights
+}
+
+// SetOption() sets the engine option with the given name.
+func SetOption(name, value string) error {
+	if name == WeightsFileOption {
+		return LoadParams(value)
+	}
+	if name == EndgamePathOption {
+		return SetEndgamePath(value)
+	}
+	if ok, err := SetBookOption(name, value); ok {
+		return err
+	}
+	if ok, err := SetTablebaseOption(name, value); ok {
+		return err
+	}
+
+	for _, w := range OptionWeights() {
+		if w.Name == name {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return err
+			}
+			if n < OptionMin(name) || n > optionLimit {
+				return errors.New("option value out of range: " + value)
+			}
+			*w.Value = n
+			ClearPawnTable()
+			return nil
+		}
+	}
+
+	return errors.New("no such option: " + name)
+}
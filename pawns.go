@@ -0,0 +1,307 @@
+// Copyright 2013 Chad Williamson.
+
+// This file is part of Turgenev, a chess program.
+
+// Turgenev is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Turgenev is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License along
+// with Turgenev. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"unsafe"
+)
+
+// Pawn structure changes far less often than the rest of the board, so its
+// evaluation is cached in a table keyed on a hash of the pawns alone. This
+// is the default number of entries; SetPawnTableSize() changes it.
+const PawnTableSize = 1 << 14
+
+type pawnEntry struct {
+	key uint64
+	valid bool
+
+	// scores and passed pawns (a bit per square) indexed by Color
+	mg, eg [3]int
+	passed [3]uint64
+}
+
+// A PawnTable is a pawn hash table, which may be shared by searches running
+// at once.
+type PawnTable struct {
+	entries []pawnEntry
+	lock sync.Mutex
+}
+
+var pawnKeys [3][64]uint64
+
+func init() {
+	r := rand.New(rand.NewSource(1))
+	for c := 0; c < 3; c++ {
+		for i := 0; i < 64; i++ {
+			pawnKeys[c][i] = uint64(r.Int63()) ^ (uint64(r.Int63()) << 1)
+		}
+	}
+}
+
+// PawnKey() returns a hash of the positions of the pawns on the board (and
+// nothing else).
+func (s *State) PawnKey() uint64 {
+	var key uint64
+
+	for i := 0; i < 64; i++ {
+		if Piece(s.board[i] & pieceMask) == Pawn {
+			key ^= pawnKeys[Color((s.board[i] & colorMask) >> 3)][i]
+		}
+	}
+
+	return key
+}
+
+// NewPawnTable() returns an empty pawn hash table with the given number of
+// entries.
+func NewPawnTable(entries int) *PawnTable {
+	return &PawnTable{entries: make([]pawnEntry, entries)}
+}
+
+// SetPawnTableSize() replaces the default evaluator's pawn hash table (and
+// the one that every Evaluator made after it starts with) with an empty one
+// of about the given number of megabytes.
+func SetPawnTableSize(megabytes int) error {
+	if megabytes < 1 {
+		return fmt.Errorf("pawn table size must be at least 1 MB, not %d", megabytes)
+	}
+
+	DefaultEvaluator.pawns = NewPawnTable((megabytes << 20) / int(unsafe.Sizeof(pawnEntry{})))
+	return nil
+}
+
+// ClearPawnTable() empties the default evaluator's pawn hash table, which
+// is necessary whenever the pawn structure weights in Params change.
+func ClearPawnTable() {
+	DefaultEvaluator.pawns.Clear()
+}
+
+// Clear() empties the table.
+func (t *PawnTable) Clear() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for i := range t.entries {
+		t.entries[i] = pawnEntry{}
+	}
+}
+
+// PawnStructureScore() returns the middlegame and endgame pawn structure
+// scores for the given player: the cached pawn-only terms plus a bonus for
+// passed pawns whose path to promotion is clear of pieces.
+func (s *State) PawnStructureScore(e *Evaluator, player Color) (mg, eg int) {
+	entry := s.probePawns(e)
+	mg, eg = entry.mg[player], entry.eg[player]
+
+	for i := 0; i < 64; i++ {
+		if entry.passed[player] & (1 << uint(i)) != 0 &&
+		   s.freePath(player, i >> 3, i & 7) {
+			eg += e.Params.EgFreePassedPawn[RelativeRank(player, i >> 3)]
+		}
+	}
+
+	return
+}
+
+// RelativeRank() returns the given row as counted from the player's side
+// of the board (0 being the player's back rank).
+func RelativeRank(player Color, row int) int {
+	if player == White {
+		return row
+	}
+	return 7 - row
+}
+
+// Return the evaluator's pawn table entry for s, evaluating and storing it
+// if it isn't cached already.
+func (s *State) probePawns(e *Evaluator) pawnEntry {
+	key, t := s.PawnKey(), e.pawns
+
+	t.lock.Lock()
+	entry := t.entries[key % uint64(len(t.entries))]
+	t.lock.Unlock()
+
+	if entry.valid && entry.key == key {
+		return entry
+	}
+
+	entry = s.evaluatePawns(e.Params)
+	entry.key, entry.valid = key, true
+
+	t.lock.Lock()
+	t.entries[key % uint64(len(t.entries))] = entry
+	t.lock.Unlock()
+
+	return entry
+}
+
+// Evaluate the pawn-only structure terms for both players.
+func (s *State) evaluatePawns(p *EvalParams) pawnEntry {
+	var entry pawnEntry
+
+	for _, player := range []Color{White, Black} {
+		forward := 1
+		if player == Black {
+			forward = -1
+		}
+
+		for i := 0; i < 8; i++ {
+			for j := 0; j < 8; j++ {
+				if s.GetPiece(i, j) != Pawn || s.GetColor(i, j) != player {
+					continue
+				}
+				mg, eg := &entry.mg[player], &entry.eg[player]
+
+				// doubled pawns are counted once per extra pawn, by
+				// each pawn with a friendly pawn in front of it
+				if s.pawnsAhead(player, player, i, j, j) {
+					*mg += p.MgDoubledPawn
+					*eg += p.EgDoubledPawn
+				}
+
+				isolated := !s.pawnOnFile(player, j - 1) &&
+					    !s.pawnOnFile(player, j + 1)
+				if isolated {
+					*mg += p.MgIsolatedPawn
+					*eg += p.EgIsolatedPawn
+				} else if s.backwardPawn(player, i, j, forward) {
+					*mg += p.MgBackwardPawn
+					*eg += p.EgBackwardPawn
+				}
+
+				if s.connectedPawn(player, i, j, forward) {
+					*mg += p.MgConnectedPawn
+					*eg += p.EgConnectedPawn
+				}
+
+				if !s.pawnsAhead(player, Opponent(player), i, j - 1, j + 1) {
+					rank := RelativeRank(player, i)
+					*mg += p.MgPassedPawn[rank]
+					*eg += p.EgPassedPawn[rank]
+					entry.passed[player] |= 1 << uint((i << 3) + j)
+				}
+			}
+		}
+	}
+
+	return entry
+}
+
+// Return true iff there is a pawn of the given color in front of the
+// player's square (row, col), on any file from c1 to c2.
+func (s *State) pawnsAhead(player, color Color, row, c1, c2 int) bool {
+	for j := c1; j <= c2; j++ {
+		if j < 0 || j > 7 {
+			continue
+		}
+		for i := row + 1; i < 8 && player == White; i++ {
+			if s.GetPiece(i, j) == Pawn && s.GetColor(i, j) == color {
+				return true
+			}
+		}
+		for i := row - 1; i >= 0 && player == Black; i-- {
+			if s.GetPiece(i, j) == Pawn && s.GetColor(i, j) == color {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Return true iff the player has a pawn anywhere on the given file.
+func (s *State) pawnOnFile(player Color, col int) bool {
+	if col < 0 || col > 7 {
+		return false
+	}
+	for i := 0; i < 8; i++ {
+		if s.GetPiece(i, col) == Pawn && s.GetColor(i, col) == player {
+			return true
+		}
+	}
+
+	return false
+}
+
+// A pawn is backward if no friendly pawn on a neighboring file stands
+// level with or behind it, and an enemy pawn guards the square in front.
+func (s *State) backwardPawn(player Color, row, col, forward int) bool {
+	for _, j := range []int{col - 1, col + 1} {
+		if j < 0 || j > 7 {
+			continue
+		}
+		for i := row; i >= 0 && i < 8; i -= forward {
+			if s.GetPiece(i, j) == Pawn && s.GetColor(i, j) == player {
+				return false
+			}
+		}
+	}
+
+	stop := row + forward
+	for _, j := range []int{col - 1, col + 1} {
+		i := stop + forward
+		if j < 0 || j > 7 || i < 0 || i > 7 {
+			continue
+		}
+		if s.GetPiece(i, j) == Pawn && s.GetColor(i, j) == Opponent(player) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// A pawn is connected if a friendly pawn stands beside it or defends it.
+func (s *State) connectedPawn(player Color, row, col, forward int) bool {
+	for _, j := range []int{col - 1, col + 1} {
+		if j < 0 || j > 7 {
+			continue
+		}
+		for _, i := range []int{row, row - forward} {
+			if i >= 0 && i < 8 && s.GetPiece(i, j) == Pawn &&
+			   s.GetColor(i, j) == player {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Return true iff every square between the player's pawn on (row, col) and
+// its promotion square is empty.
+func (s *State) freePath(player Color, row, col int) bool {
+	if player == White {
+		for i := row + 1; i < 8; i++ {
+			if s.GetPiece(i, col) != Empty {
+				return false
+			}
+		}
+	} else {
+		for i := row - 1; i >= 0; i-- {
+			if s.GetPiece(i, col) != Empty {
+				return false
+			}
+		}
+	}
+
+	return true
+}
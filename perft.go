@@ -0,0 +1,87 @@
+// Copyright 2013 Chad Williamson.
+
+// This file is part of Turgenev, a chess program.
+
+// Turgenev is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Turgenev is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License along
+// with Turgenev. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Perft() counts the leaf nodes of the legal move tree of the given depth
+// below s, which is the standard check of a move generator: the counts for
+// well-known positions are published.
+func (s *State) Perft(depth int) int {
+	if depth == 0 {
+		return 1
+	}
+
+	successors := s.LegalSuccessors()
+	if depth == 1 {
+		return successors.Len()
+	}
+
+	n := 0
+	for e := successors.Front(); e != nil; e = e.Next() {
+		n += e.Value.(*State).Perft(depth - 1)
+	}
+	return n
+}
+
+// Perft() is the "perft" subcommand, which counts the positions the given
+// number of plies from the starting position (or a FEN), optionally broken
+// down by first move.
+func Perft(args []string) int {
+	flags := flag.NewFlagSet("perft", flag.ExitOnError)
+	fen := flags.String("fen", InitialFEN, "position to start from")
+	divide := flags.Bool("divide", false, "print the count below each legal move")
+	flags.Parse(args)
+
+	depth, err := strconv.Atoi(flags.Arg(0))
+	if flags.NArg() != 1 || err != nil || depth < 0 {
+		fmt.Fprintln(os.Stderr, "usage: turgenev perft [-fen FEN] [-divide] DEPTH")
+		return 2
+	}
+
+	s, err := StateFromFEN(*fen)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	start, total := time.Now(), 0
+	if *divide && depth > 0 {
+		successors := s.LegalSuccessors()
+		for e := successors.Front(); e != nil; e = e.Next() {
+			c := e.Value.(*State)
+			n := c.Perft(depth - 1)
+			fmt.Printf("%-8s%12d\n", MoveString(s, c, Coordinate), n)
+			total += n
+		}
+		fmt.Println()
+	} else {
+		total = s.Perft(depth)
+	}
+	elapsed := time.Since(start)
+
+	fmt.Printf("Perft(%d): %d nodes in %.2f s (%.0f nodes/s)\n", depth, total,
+		   elapsed.Seconds(), float64(total) / elapsed.Seconds())
+	return 0
+}
@@ -0,0 +1,531 @@
+// Copyright 2013 Chad Williamson.
+
+// This file is part of Turgenev, a chess program.
+
+// Turgenev is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Turgenev is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License along
+// with Turgenev. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// A PGNGame is a game read from a PGN file or being recorded: its tag pairs,
+// the moves of the main line (in SAN), the result token and, for recorded
+// games, a comment for each move (which may be empty).
+type PGNGame struct {
+	Tags map[string]string
+	Moves []string
+	Result string
+	Comments []string
+}
+
+// Where to write finished games (a file to append to or a directory to put
+// a new file in), and whether to comment the engine's moves with their
+// evaluation, depth and time
+var (
+	PGNOut string = ""
+	PGNComments bool = true
+
+	// The game GameLoop() is playing
+	CurrentGame *PGNGame
+)
+
+// The Seven Tag Roster, in the order export format wants it
+var sevenTagRoster = []string{"Event", "Site", "Date", "Round", "White", "Black", "Result"}
+
+// ReadPGNFile() reads all of the games in a PGN file.
+func ReadPGNFile(path string) ([]*PGNGame, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePGN(string(data)), nil
+}
+
+// ParsePGN() splits PGN text into games. Comments, variations, numeric
+// annotation glyphs and move numbers are skipped. A game ends at its result
+// token, or at the start of the next game's tags if the result is missing.
+func ParsePGN(text string) []*PGNGame {
+	var games []*PGNGame
+	g := &PGNGame{Tags: make(map[string]string)}
+
+	finish := func() {
+		if len(g.Tags) > 0 || len(g.Moves) > 0 {
+			games = append(games, g)
+		}
+		g = &PGNGame{Tags: make(map[string]string)}
+	}
+
+	for i := 0; i < len(text); {
+		switch c := text[i]; {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case c == '%' && (i == 0 || text[i - 1] == '\n'), c == ';':
+			i = skipPast(text, i, "\n")
+		case c == '{':
+			i = skipPast(text, i, "}")
+		case c == '(':
+			i = skipVariation(text, i)
+		case c == '[':
+			if len(g.Moves) > 0 {
+				finish()
+			}
+			end := skipPast(text, i, "]")
+			name, value := parseTag(text[i + 1:end - 1])
+			if name != "" {
+				g.Tags[name] = value
+			}
+			i = end
+		default:
+			j := i
+			for j < len(text) && !strings.ContainsRune(" \t\r\n{}()[];", rune(text[j])) {
+				j++
+			}
+			if j == i {
+				j++
+			}
+			token := text[i:j]
+			i = j
+
+			switch token {
+			case "1-0", "0-1", "1/2-1/2", "*":
+				g.Result = token
+				finish()
+				continue
+			}
+			if token[0] == '$' {
+				continue
+			}
+			token = stripMoveNumber(token)
+			if token != "" {
+				g.Moves = append(g.Moves, token)
+			}
+		}
+	}
+	finish()
+
+	return games
+}
+
+// Return token without a leading move number ("12." or "12..."), which
+// may be written against the move itself. Digits not followed by a period
+// are left alone, so castling written with zeros survives.
+func stripMoveNumber(token string) string {
+	i := 0
+	for i < len(token) && unicode.IsDigit(rune(token[i])) {
+		i++
+	}
+	j := i
+	for j < len(token) && token[j] == '.' {
+		j++
+	}
+	if i == 0 || j == i {
+		return token
+	}
+	return token[j:]
+}
+
+// Return the index just past the first occurrence of end in text at or
+// after i (or the end of the text)
+func skipPast(text string, i int, end string) int {
+	j := strings.Index(text[i:], end)
+	if j < 0 {
+		return len(text)
+	}
+	return i + j + len(end)
+}
+
+// Return the index just past the variation starting at text[i], which may
+// contain variations and comments of its own
+func skipVariation(text string, i int) int {
+	depth := 0
+
+	for i < len(text) {
+		switch text[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		case '{':
+			i = skipPast(text, i, "}")
+			continue
+		case ';':
+			i = skipPast(text, i, "\n")
+			continue
+		}
+		i++
+	}
+
+	return i
+}
+
+// Split the inside of a tag pair, e.g. `White "Turgenev"`, into its name and
+// (unescaped) value
+func parseTag(tag string) (name, value string) {
+	tag = strings.TrimSpace(tag)
+	i := strings.IndexFunc(tag, unicode.IsSpace)
+	if i < 0 {
+		return tag, ""
+	}
+
+	name, value = tag[:i], strings.TrimSpace(tag[i:])
+	value = strings.TrimPrefix(value, "\"")
+	value = strings.TrimSuffix(value, "\"")
+	value = strings.Replace(value, "\\\"", "\"", -1)
+	value = strings.Replace(value, "\\\\", "\\", -1)
+	return
+}
+
+// StartState() returns the position the game starts from: the one given by
+// its FEN tag, if it has one, or else the usual starting position.
+func (g *PGNGame) StartState() (*State, error) {
+	if fen, ok := g.Tags["FEN"]; ok {
+		return StateFromFEN(fen)
+	}
+	return InitialState(), nil
+}
+
+// States() replays the game, returning the position before each move
+// followed by the final position.
+func (g *PGNGame) States() ([]*State, error) {
+	s, err := g.StartState()
+	if err != nil {
+		return nil, err
+	}
+
+	states := []*State{s}
+	for _, move := range g.Moves {
+		t := s.SANSuccessor(move)
+		if t == nil {
+			return states, errors.New("illegal or ambiguous move: " + move)
+		}
+		states = append(states, t)
+		s = t
+	}
+
+	return states, nil
+}
+
+// SANSuccessor() returns the legal successor of s described by a move in
+// Standard Algebraic Notation, or nil if there isn't exactly one. Check
+// marks and annotations are ignored, as are the separators of long
+// algebraic notation ("Ng1-f3"), and the promotion's '=' is optional.
+func (s *State) SANSuccessor(san string) *State {
+	if matches, _ := s.SANMatches(san); len(matches) == 1 {
+		return matches[0]
+	}
+	return nil
+}
+
+// SANMatches() returns all of the legal successors of s that a move in SAN
+// (read as in SANSuccessor()) could mean, and false if it isn't SAN at all.
+// A pawn move to the last rank without a promotion piece matches all four
+// promotions.
+func (s *State) SANMatches(san string) ([]*State, bool) {
+	san = strings.TrimRight(san, "+#!?")
+	if san == "" {
+		return nil, false
+	}
+
+	switch san {
+	case "O-O", "0-0":
+		return stateList(s.castlingSuccessor(6)), true
+	case "O-O-O", "0-0-0":
+		return stateList(s.castlingSuccessor(2)), true
+	}
+
+	promotion := Piece(Empty)
+	if i := strings.Index(san, "="); i >= 0 {
+		if i + 1 < len(san) {
+			promotion = PieceFromRune(rune(san[i + 1]))
+		}
+		if promotion == Empty || promotion == Pawn || promotion == King {
+			return nil, false
+		}
+		san = san[:i]
+	} else if n := len(san); n > 2 && strings.ContainsRune("NBRQ", rune(san[n - 1])) &&
+		  san[n - 2] >= '1' && san[n - 2] <= '8' {
+		promotion = PieceFromRune(rune(san[n - 1]))
+		san = san[:n - 1]
+	}
+	if san == "" {
+		return nil, false
+	}
+
+	piece := Piece(Pawn)
+	if strings.ContainsRune("NBRQK", rune(san[0])) {
+		piece = PieceFromRune(rune(san[0]))
+		san = san[1:]
+	}
+	san = strings.Replace(san, "x", "", -1)
+	san = strings.Replace(san, "-", "", -1)
+	if len(san) < 2 || len(san) > 4 {
+		return nil, false
+	}
+
+	// The destination, preceded by whatever disambiguates the origin
+	dest, from := san[len(san) - 2:], san[:len(san) - 2]
+	c2, r2 := int(dest[0]) - 'a', int(dest[1]) - '1'
+	if c2 < 0 || c2 > 7 || r2 < 0 || r2 > 7 {
+		return nil, false
+	}
+	c1, r1 := -1, -1
+	for _, r := range from {
+		switch {
+		case r >= 'a' && r <= 'h':
+			c1 = int(r - 'a')
+		case r >= '1' && r <= '8':
+			r1 = int(r - '1')
+		default:
+			return nil, false
+		}
+	}
+
+	var matches []*State
+	for e := s.LegalSuccessors().Front(); e != nil; e = e.Next() {
+		t := e.Value.(*State)
+		if s.castled(t) {
+			continue
+		}
+		tr1, tc1, tr2, tc2 := MoveSquares(s, t)
+		if tr2 != r2 || tc2 != c2 || s.GetPiece(tr1, tc1) != piece ||
+		   (c1 >= 0 && tc1 != c1) || (r1 >= 0 && tr1 != r1) {
+			continue
+		}
+		if promotion != Empty && t.GetPiece(r2, c2) != promotion {
+			continue
+		}
+		matches = append(matches, t)
+	}
+
+	return matches, true
+}
+
+// Return a slice holding s, or an empty one if s is nil
+func stateList(s *State) []*State {
+	if s == nil {
+		return nil
+	}
+	return []*State{s}
+}
+
+// Return the successor of s in which the player to move castles with the
+// king ending up on the given column, or nil if that isn't legal
+func (s *State) castlingSuccessor(col int) *State {
+	for e := s.LegalSuccessors().Front(); e != nil; e = e.Next() {
+		t := e.Value.(*State)
+		if !s.castled(t) {
+			continue
+		}
+		if _, _, _, c2 := MoveSquares(s, t); c2 == col {
+			return t
+		}
+	}
+
+	return nil
+}
+
+// NewPGNGame() returns an empty record of a game starting from s, with the
+// Seven Tag Roster filled in (the players as unknown).
+func NewPGNGame(s *State) *PGNGame {
+	g := &PGNGame{Tags: map[string]string{
+		"Event": "Casual game",
+		"Site": "?",
+		"Date": time.Now().Format("2006.01.02"),
+		"Round": "-",
+		"White": "?",
+		"Black": "?",
+		"Result": "*",
+	}, Result: "*"}
+
+	if fen := s.FEN(); fen != InitialFEN {
+		g.Tags["SetUp"], g.Tags["FEN"] = "1", fen
+	}
+
+	return g
+}
+
+// AddMove() records the move from s to t, with a comment (or "" for none).
+func (g *PGNGame) AddMove(s, t *State, comment string) {
+	for len(g.Comments) < len(g.Moves) {
+		g.Comments = append(g.Comments, "")
+	}
+	g.Moves = append(g.Moves, MoveString(s, t, Algebraic))
+	g.Comments = append(g.Comments, comment)
+}
+
+// SetEngine() records that Turgenev is playing the given color, against an
+// opponent with the given name.
+func (g *PGNGame) SetEngine(player Color, opponent string) {
+	white, black := "Turgenev", opponent
+	if player == Black {
+		white, black = black, white
+	}
+	g.Tags["White"], g.Tags["Black"] = white, black
+}
+
+// SetResult() records how the game ended: "1-0", "0-1", "1/2-1/2" or "*".
+func (g *PGNGame) SetResult(result string) {
+	g.Result, g.Tags["Result"] = result, result
+}
+
+// GameResult() returns the result of a game that ended in s: "1-0" or "0-1"
+// after checkmate, "1/2-1/2" after stalemate and "*" if it isn't over.
+func (s *State) GameResult() string {
+	switch {
+	case s.HasLegalMove():
+		return "*"
+	case !s.InCheck():
+		return "1/2-1/2"
+	case s.GetToMove() == Black:
+		return "1-0"
+	}
+	return "0-1"
+}
+
+// SearchComment() describes a search for the comment on the move it chose:
+// the score in pawns (or "M" and the moves to mate) for the player who
+// moved, the depth and the time taken, as in "+0.35/4 1.2s".
+func SearchComment(sc *SearchContext) string {
+	score := fmt.Sprintf("%+.2f", float64(sc.Eval.Centipawns(sc.LastScore)) / 100)
+	if IsMateScore(sc.LastScore) {
+		score = mateText(MateDistance(sc.LastScore))
+	}
+	return fmt.Sprintf("%s/%d %.1fs", score, sc.LastDepth, sc.WallTime.Seconds())
+}
+
+// FirstMove() returns the number of the game's first move and whether Black
+// makes it, which carry on from the FEN tag's position, if there is one.
+func (g *PGNGame) FirstMove() (number int, black bool) {
+	number = 1
+	if fen, ok := g.Tags["FEN"]; ok {
+		fields := strings.Fields(fen)
+		black = len(fields) > 1 && fields[1] == "b"
+		if len(fields) > 5 {
+			if n, err := strconv.Atoi(fields[5]); err == nil && n > 0 {
+				number = n
+			}
+		}
+	}
+	return
+}
+
+// String() writes the game in PGN export format: the Seven Tag Roster
+// followed by any other tags in alphabetical order, then the movetext,
+// wrapped to fit in 80 columns.
+func (g *PGNGame) String() string {
+	var b strings.Builder
+
+	names := append([]string(nil), sevenTagRoster...)
+	var others []string
+	for name := range g.Tags {
+		if !containsString(sevenTagRoster, name) {
+			others = append(others, name)
+		}
+	}
+	sort.Strings(others)
+	for _, name := range append(names, others...) {
+		value, ok := g.Tags[name]
+		if !ok {
+			value = "?"
+		}
+		value = strings.Replace(value, "\\", "\\\\", -1)
+		value = strings.Replace(value, "\"", "\\\"", -1)
+		fmt.Fprintf(&b, "[%s \"%s\"]\n", name, value)
+	}
+	b.WriteString("\n")
+
+	number, black := g.FirstMove()
+	var tokens []string
+	for i, move := range g.Moves {
+		if !black {
+			tokens = append(tokens, fmt.Sprintf("%d.", number))
+		} else if i == 0 {
+			tokens = append(tokens, fmt.Sprintf("%d...", number))
+		}
+		tokens = append(tokens, move)
+		if i < len(g.Comments) && g.Comments[i] != "" {
+			tokens = append(tokens, "{" + strings.Replace(g.Comments[i], "}", ")", -1) + "}")
+		}
+
+		if black {
+			number++
+		}
+		black = !black
+	}
+	result := g.Result
+	if result == "" {
+		result = "*"
+	}
+	tokens = append(tokens, result)
+
+	column := 0
+	for _, token := range tokens {
+		if column > 0 && column + 1 + len(token) > 79 {
+			b.WriteString("\n")
+			column = 0
+		}
+		if column > 0 {
+			b.WriteString(" ")
+			column++
+		}
+		b.WriteString(token)
+		column += len(token)
+	}
+	b.WriteString("\n")
+
+	return b.String()
+}
+
+// Return true iff list contains s
+func containsString(list []string, s string) bool {
+	for _, t := range list {
+		if t == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Save() appends the game to the PGN file at path or, if path is a
+// directory, writes it to a new file there named for the time.
+func (g *PGNGame) Save(path string) error {
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		name := "turgenev-" + time.Now().Format("20060102-150405") + ".pgn"
+		path = filepath.Join(path, name)
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(g.String() + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,71 @@
+// Copyright 2013 Chad Williamson.
+
+// This file is part of Turgenev, a chess program.
+
+// Turgenev is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Turgenev is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License along
+// with Turgenev. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestParsePGN(t *testing.T) {
+	const text = `[Event "Test"]
+[White "A"]
+[Black "B"]
+
+1. e4 {best by test} e5 2. Nf3 (2. f4 exf4) Nc6 $1 3. Bb5 a6 1-0
+
+[Event "Next"]
+1. d4 d5 *`
+
+	games := ParsePGN(text)
+	if len(games) != 2 {
+		t.Fatalf("%d games, want 2", len(games))
+	}
+	g := games[0]
+	if g.Tags["Event"] != "Test" || g.Tags["White"] != "A" || g.Result != "1-0" {
+		t.Errorf("first game's tags %q, result %q", g.Tags, g.Result)
+	}
+	states, err := g.States()
+	if err != nil || len(states) != 7 {
+		t.Fatalf("%v: %d positions, %v", g.Moves, len(states), err)
+	}
+	want := "r1bqkbnr/1ppp1ppp/p1n5/1B2p3/4P3/5N2/PPPP1PPP/RNBQK2R w KQkq - 0 4"
+	if positionKey(states[6]) != positionKey(mustFEN(t, want)) {
+		t.Errorf("game ends at %s, want %s", states[6].FEN(), want)
+	}
+	if g := games[1]; g.Tags["Event"] != "Next" || len(g.Moves) != 2 || g.Result != "*" {
+		t.Errorf("second game: tags %q, moves %v, result %q", g.Tags, g.Moves, g.Result)
+	}
+}
+
+// Moves that aren't SAN, however close they come, are errors.
+func TestBadSAN(t *testing.T) {
+	s := InitialState()
+	for _, san := range []string{"=Q", "=q", "=", "e9", "Nf", "Qxx", "e4=K", "e8=P", "Ke2-e3-e4"} {
+		if matches, ok := s.SANMatches(san); ok && len(matches) > 0 {
+			t.Errorf("SANMatches(%q) matched %d moves", san, len(matches))
+		}
+		if c, err := s.ParseMove(san); err == nil {
+			t.Errorf("ParseMove(%q) gave %s", san, c.FEN())
+		}
+	}
+
+	g := ParsePGN("1. e4 =Q *")[0]
+	if states, err := g.States(); err == nil || len(states) != 2 {
+		t.Errorf("%v replayed to %d positions, %v", g.Moves, len(states), err)
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2013 Chad Williamson.
+
+// This file is part of Turgenev, a chess program.
+
+// Turgenev is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Turgenev is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License along
+// with Turgenev. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// A Replay is a game loaded from a PGN file to step through: the game, the
+// position before each of its moves (and after the last) and how many
+// plies into it we are.
+type Replay struct {
+	Game *PGNGame
+	States []*State
+	Ply int
+}
+
+// The game being replayed, if any. Playing a move from one of its positions
+// doesn't unload it, so it's always possible to go back.
+var CurrentReplay *Replay
+
+// LoadReplay() loads the given game (counting from 1) of a PGN file. Every
+// move is checked against the move generator; if one is illegal, the moves
+// before it are kept and the error is returned along with the replay.
+func LoadReplay(path string, number int) (*Replay, error) {
+	games, err := ReadPGNFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if number < 1 || number > len(games) {
+		return nil, fmt.Errorf("%s has %d games", path, len(games))
+	}
+
+	g := games[number - 1]
+	states, err := g.States()
+	if len(states) == 0 {
+		return nil, err
+	}
+	if err != nil {
+		err = fmt.Errorf("%v (keeping the first %d moves)", err, len(states) - 1)
+	}
+	return &Replay{Game: g, States: states}, err
+}
+
+// State() returns the position we're at.
+func (r *Replay) State() *State {
+	return r.States[r.Ply]
+}
+
+// Goto() moves to the position after the given number of plies, staying
+// within the game.
+func (r *Replay) Goto(ply int) {
+	switch {
+	case ply < 0:
+		ply = 0
+	case ply >= len(r.States):
+		ply = len(r.States) - 1
+	}
+	r.Ply = ply
+}
+
+// Record() returns the game up to the position we're at, for carrying on
+// from there.
+func (r *Replay) Record() *PGNGame {
+	g := &PGNGame{Tags: make(map[string]string), Moves: r.Game.Moves[:r.Ply:r.Ply]}
+	for name, value := range r.Game.Tags {
+		g.Tags[name] = value
+	}
+	g.SetResult("*")
+	return g
+}
+
+// String() describes where we are in the game, e.g. "After 12. Nf3 (ply 23
+// of 80)".
+func (r *Replay) String() string {
+	if r.Ply == 0 {
+		return fmt.Sprintf("Start of the game (%d plies)", len(r.States) - 1)
+	}
+
+	number, black := r.Game.FirstMove()
+	ply := r.Ply - 1
+	if black {
+		ply++
+	}
+	dots := "."
+	if ply % 2 == 1 {
+		dots = "..."
+	}
+	return fmt.Sprintf("After %d%s %s (ply %d of %d)", number + ply / 2, dots,
+			   r.Game.Moves[r.Ply - 1], r.Ply, len(r.States) - 1)
+}
+
+// ReplayCommand() carries out one of the commands for replaying games:
+// "load FILE [N]", "next [N]", "prev [N]" and "goto PLY" (or "goto start"
+// or "goto end"). It returns the position to go to.
+func ReplayCommand(command string, args []string) (*State, error) {
+	if command == "load" {
+		if len(args) == 0 {
+			return nil, errors.New("usage: load FILE [GAME]")
+		}
+		number := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil {
+				return nil, errors.New("bad game number: " + args[1])
+			}
+			number = n
+		}
+
+		r, err := LoadReplay(args[0], number)
+		if r == nil {
+			return nil, err
+		}
+		if err != nil {
+			fmt.Printf("\n%v\n", err)
+		}
+		CurrentReplay = r
+		return r.State(), nil
+	}
+
+	r := CurrentReplay
+	if r == nil {
+		return nil, errors.New("no game loaded (use \"load FILE\")")
+	}
+
+	n := 1
+	if len(args) > 0 {
+		switch args[0] {
+		case "start":
+			n = 0
+		case "end":
+			n = len(r.States) - 1
+		default:
+			var err error
+			if n, err = strconv.Atoi(args[0]); err != nil {
+				return nil, errors.New("bad number of plies: " + args[0])
+			}
+		}
+	} else if command == "goto" {
+		return nil, errors.New("usage: goto PLY|start|end")
+	}
+
+	switch command {
+	case "next":
+		r.Goto(r.Ply + n)
+	case "prev":
+		r.Goto(r.Ply - n)
+	case "goto":
+		r.Goto(n)
+	}
+	return r.State(), nil
+}
@@ -18,6 +18,7 @@
 package main
 
 import (
+	"sort"
 	"time"
 )
 
@@ -25,46 +26,270 @@ const (
 	PosInfinity =  1 << 24
 	NegInfinity = -1 << 24
 	UNSET = 1 << 30
+
+	// A side that is checkmated at ply p scores -(Mate - p), so that
+	// shorter mates are preferred to longer ones. Scores within MaxPly of
+	// Mate are mate scores rather than material evaluations.
+	Mate = 1 << 20
+	MaxPly = 1 << 8
+)
+
+var (
+	// Selectivity of Negamax(), which can be turned off for comparison
+	NullMovePruning bool = true
+	LateMoveReductions bool = true
+	CheckExtensions bool = true
 )
 
-// Duration of the last search
-var WallTime time.Duration
+// A SearchContext holds everything one search uses and finds out, so that
+// any number of searches can run at once (each with its own context).
+type SearchContext struct {
+	// Evaluation function and weights
+	Eval *Evaluator
+
+	// When the search has to stop (the zero time for no limit): the
+	// iteration in progress then is abandoned, and the last completed
+	// one's move is played.
+	Deadline time.Time
+	timeUp bool
+
+	// Duration of the search
+	WallTime time.Duration
+
+	// Score of the search (for the side that made the chosen move)
+	LastScore int
+
+	// Number of states visited
+	Nodes int
+
+	// Depth of the last completed iteration
+	LastDepth int
+
+	// Depth of the current iteration at the root, which bounds extensions
+	rootDepth int
+
+	// Statistics for the search
+	Stats SearchStats
+}
+
+// NewSearch() returns a context for a search with the given evaluator and
+// no deadline.
+func NewSearch(e *Evaluator) *SearchContext {
+	return &SearchContext{Eval: e}
+}
+
+// SearchStats counts how often the search had to look at a move again
+// after a cheaper search of it turned out to be wrong.
+type SearchStats struct {
+	// Null-window scouts that beat alpha and needed a full window
+	PVSResearches int
+
+	// Reduced searches of late moves that beat alpha
+	LMRResearches int
+
+	// Iterations whose score fell outside the aspiration window
+	AspirationResearches int
+}
+
+const (
+	// A null move is searched this much shallower than a real one.
+	nullMoveReduction = 2
+
+	// Quiet moves after the first few at each node are searched one ply
+	// shallower (and again at full depth should they beat alpha).
+	lateMoveIndex = 3
+	lateMoveReduction = 1
+
+	// Half-width of the first aspiration window (a quarter of a pawn)
+	aspirationWindow = 020
+
+	// The clock is checked every this many nodes (a power of two).
+	deadlineInterval = 1 << 10
+)
 
 // SearchFunction is a type common to all searches used for passing such
-// functions to GameLoop() (for example) as parameters.
-type SearchFunction func(*State, int) *State
+// functions to GameLoop() (for example) as parameters. The search's
+// results go in the context.
+type SearchFunction func(*SearchContext, *State, int) *State
 
 // NegamaxST() is a single-threaded negamax search with alpha-beta pruning.
-func NegamaxST(s *State, depth int) *State {
+// It deepens iteratively, searching the best move of each iteration first
+// in the next, and looks for each iteration's score in an aspiration window
+// around the last one's, widening the window when the score falls outside.
+// It stops early at the context's Deadline, if there is one (though the
+// first iteration is always finished).
+func NegamaxST(sc *SearchContext, s *State, depth int) *State {
 	start := time.Now()
+	sc.Nodes, sc.Stats, sc.LastDepth, sc.timeUp = 0, SearchStats{}, 0, false
 
-	children, bestValue := s.LegalSuccessors(), NegInfinity
+	children := s.OrderedSuccessors(sc.Eval)
 	var choice *State
+	score := 0
 
-	for e := children.Front(); e != nil; e = e.Next() {
-		child := e.Value.(*State)
-		value := -child.Negamax(depth - 1, NegInfinity, PosInfinity)
-		if value >= bestValue {
-			bestValue = value
-			choice = child
+	for d := 1; d <= depth && len(children) > 0 && !sc.timeUp; d++ {
+		sc.rootDepth = d
+		alpha, beta, delta := NegInfinity, PosInfinity, aspirationWindow
+		if d > 1 && !IsMateScore(score) {
+			alpha, beta = score - delta, score + delta
+		}
+
+		for {
+			c, value := s.searchRoot(sc, children, d, alpha, beta)
+			if sc.timeUp {
+				break
+			}
+			if value <= alpha && alpha > NegInfinity {
+				alpha = value - delta
+				if alpha < NegInfinity {
+					alpha = NegInfinity
+				}
+			} else if value >= beta && beta < PosInfinity {
+				beta = value + delta
+				if beta > PosInfinity {
+					beta = PosInfinity
+				}
+			} else {
+				choice, score, sc.LastDepth = c, value, d
+				break
+			}
+			sc.Stats.AspirationResearches++
+			delta <<= 1
+		}
+
+		for i, child := range children {
+			if child == choice {
+				copy(children[1:i + 1], children[:i])
+				children[0] = choice
+				break
+			}
 		}
 	}
 
-	WallTime = time.Since(start)
+	sc.LastScore = score
+	sc.WallTime = time.Since(start)
 	return choice
 }
 
-// Negamax() is the inner recursive part of the negamax search.
-func (s *State) Negamax(depth, alpha, beta int) int {
-	if depth == 0 || s.LostKing() {
-		return s.Value()
+// Search the (ordered) children of the root with a principal variation
+// search, returning the best one and its value.
+func (s *State) searchRoot(sc *SearchContext, children []*State, depth, alpha, beta int) (*State, int) {
+	best, bestValue := children[0], NegInfinity
+
+	for i, child := range children {
+		var value int
+		if i == 0 {
+			value = -child.Negamax(sc, depth - 1, 1, -beta, -alpha)
+		} else {
+			value = -child.Negamax(sc, depth - 1, 1, -alpha - 1, -alpha)
+			if value > alpha && value < beta {
+				sc.Stats.PVSResearches++
+				value = -child.Negamax(sc, depth - 1, 1, -beta, -alpha)
+			}
+		}
+
+		if value > bestValue {
+			best, bestValue = child, value
+		}
+		if value > alpha {
+			alpha = value
+		}
+		if alpha >= beta {
+			break
+		}
 	}
 
-	children := s.LegalSuccessors()
+	return best, bestValue
+}
+
+// Negamax() is the inner recursive part of the negamax search. The ply is
+// the distance from the root, used to prefer shorter mates.
+func (s *State) Negamax(sc *SearchContext, depth, ply, alpha, beta int) int {
+	sc.Nodes++
+
+	// Once time is up, the values don't matter; the iteration is thrown
+	// away.
+	if sc.Nodes % deadlineInterval == 0 && sc.rootDepth > 1 && !sc.Deadline.IsZero() &&
+	   time.Now().After(sc.Deadline) {
+		sc.timeUp = true
+	}
+	if sc.timeUp {
+		return 0
+	}
+
+	// Positions in the endgame tables and tablebases have exact values
+	// (though Syzygy's mates are still scored as mates).
+	if wdl, plies, ok := s.ProbeEndgame(); ok {
+		return EndgameValue(wdl, plies, ply)
+	}
+	if s.TablebaseEligible() && s.HasLegalMove() {
+		if wdl, ok := s.ProbeWDL(); ok {
+			return TablebaseValue(wdl, ply)
+		}
+	}
+
+	if depth == 0 {
+		if !s.HasLegalMove() {
+			return s.TerminalValue(ply)
+		}
+		return s.Quiesce(sc, alpha, beta)
+	}
+
+	children := s.OrderedSuccessors(sc.Eval)
+	if len(children) == 0 {
+		return s.TerminalValue(ply)
+	}
+	inCheck := s.InCheck()
+
+	// Null-move pruning: if passing still leaves us at or above beta
+	// after a reduced search, a real move will almost certainly do too.
+	// Passing isn't an option in check, twice in a row or without pieces
+	// (pawn endings are full of zugzwang, where passing would be best).
+	if NullMovePruning && depth > nullMoveReduction && !inCheck &&
+	   !s.IsNullMove() && s.hasPieces(s.GetToMove()) && beta < Mate - MaxPly {
+		value := -s.NullMove().Negamax(sc, depth - 1 - nullMoveReduction,
+					       ply + 1, -beta, -beta + 1)
+		if value >= beta {
+			return beta
+		}
+	}
+
+	for i, child := range children {
+		newDepth := depth - 1
+
+		// Check extension: look one ply further past checks (within
+		// reason, lest a series of checks run on forever).
+		givesCheck := child.InCheck()
+		if CheckExtensions && givesCheck && ply + depth < 2 * sc.rootDepth {
+			newDepth++
+		}
+
+		// Principal variation search: the first move gets the full
+		// window, and the rest are only checked to be no better than it
+		// with a null window (at reduced depth for late quiet moves)
+		// unless they turn out to be.
+		var value int
+		if i == 0 {
+			value = -child.Negamax(sc, newDepth, ply + 1, -beta, -alpha)
+		} else {
+			reduced := LateMoveReductions && i >= lateMoveIndex &&
+				   depth >= 3 && !inCheck && !givesCheck &&
+				   s.quietMove(child)
+			if reduced {
+				value = -child.Negamax(sc, newDepth - lateMoveReduction,
+						       ply + 1, -alpha - 1, -alpha)
+				if value > alpha {
+					sc.Stats.LMRResearches++
+				}
+			}
+			if !reduced || value > alpha {
+				value = -child.Negamax(sc, newDepth, ply + 1, -alpha - 1, -alpha)
+			}
+			if value > alpha && value < beta {
+				sc.Stats.PVSResearches++
+				value = -child.Negamax(sc, newDepth, ply + 1, -beta, -alpha)
+			}
+		}
 
-	for e := children.Front(); e != nil; e = e.Next() {
-		child := e.Value.(*State)
-		value := -child.Negamax(depth - 1, -beta, -alpha)
 		if value >= beta {
 			return value
 		}
@@ -76,35 +301,143 @@ func (s *State) Negamax(depth, alpha, beta int) int {
 	return alpha
 }
 
-// Value() is the State evaluation function, which returns an integer.
-func (s *State) Value() int {
-	value := 0
+// NullMove() returns the state that results from the player to move
+// passing. Its predecessor is s itself, so no en passant capture is
+// possible after it.
+func (s *State) NullMove() *State {
+	t := CopyState(s)
+	t.SetPredecessor(s)
+	t.SetToMove(Opponent(s.GetToMove()))
+	return t
+}
 
-	value += s.MaterialAdvantage()
-	value += s.PositionAppeal()
+// IsNullMove() returns true iff s was reached by a null move.
+func (s *State) IsNullMove() bool {
+	p := s.GetPredecessor()
+	if p == nil || p.GetToMove() == s.GetToMove() {
+		return false
+	}
 
-	return value
+	for i := 0; i < 64; i++ {
+		if p.board[i] != s.board[i] {
+			return false
+		}
+	}
+	return true
 }
 
-// PositionAppeal() is one element of the evaluation function which returns
-// an integer expressing the favorability of material distribution on the
-// board.
-func (s *State) PositionAppeal() int {
-	value, player := 0, s.GetToMove()
+// Return true iff the player has anything besides the king and pawns
+func (s *State) hasPieces(player Color) bool {
+	for i := 0; i < 64; i++ {
+		piece := Piece(s.board[i] & pieceMask)
+		if Color((s.board[i] & colorMask) >> 3) == player &&
+		   piece != Pawn && piece != King && piece != Empty {
+			return true
+		}
+	}
+	return false
+}
 
-	// we like to control the center of the board...
-	for i := 3; i < 5; i++ {
-		for j := 2; j < 6; j++ {
-			color := s.GetColor(i, j)
-			if color == player {
-				piece := s.GetPiece(i, j)
-				value += (MaterialValue(piece) >> 6)
-			} else if color == Opponent(player) {
-				piece := s.GetPiece(i, j)
-				value -= (MaterialValue(piece) >> 6)
+// Return true iff the move from s to t neither captures nor promotes
+func (s *State) quietMove(t *State) bool {
+	enemy := Opponent(s.GetToMove())
+	return popCount(t.occupiedBy(enemy)) == popCount(s.occupiedBy(enemy)) &&
+	       t.countPieces(Pawn) == s.countPieces(Pawn)
+}
+
+// Return true iff the move from s to t is a promotion
+func (s *State) promotion(t *State) bool {
+	r1, c1, r2, c2 := MoveSquares(s, t)
+	return s.GetPiece(r1, c1) == Pawn && t.GetPiece(r2, c2) != Pawn
+}
+
+// OrderedSuccessors() returns the legal successors of s with the most
+// promising ones first, to make the most of alpha-beta pruning: captures
+// that win or hold material by SEE, then quiet moves (in the order they
+// were generated), then captures that lose material. The evaluator's piece
+// values decide which captures those are.
+func (s *State) OrderedSuccessors(ev *Evaluator) []*State {
+	successors := s.LegalSuccessors()
+	children := make([]*State, 0, successors.Len())
+	keys := make(map[*State]int)
+	enemy := Opponent(s.GetToMove())
+	enemies := popCount(s.occupiedBy(enemy))
+
+	for e := successors.Front(); e != nil; e = e.Next() {
+		child := e.Value.(*State)
+		if popCount(child.occupiedBy(enemy)) < enemies {
+			if gain := s.MoveSEE(ev, child); gain >= 0 {
+				keys[child] = PosInfinity + gain
+			} else {
+				keys[child] = NegInfinity + gain
 			}
 		}
+		children = append(children, child)
+	}
+
+	sort.SliceStable(children, func(i, j int) bool {
+		return keys[children[i]] > keys[children[j]]
+	})
+	return children
+}
+
+// Quiesce() is a quiescence search, which plays out captures and promotions
+// until the position is quiet, so that Value() isn't fooled by a piece that
+// is about to be taken. The player to move may always "stand pat" instead.
+func (s *State) Quiesce(sc *SearchContext, alpha, beta int) int {
+	standPat := s.Value(sc.Eval)
+	if standPat >= beta {
+		return standPat
+	}
+	if standPat > alpha {
+		alpha = standPat
+	}
+
+	// Captures that lose material by SEE can be skipped, since standing
+	// pat is at least as good. (Promotions are always worth a look.)
+	captures, gains := s.Captures(), make(map[*State]int)
+	children := make([]*State, 0, captures.Len())
+	for e := captures.Front(); e != nil; e = e.Next() {
+		child := e.Value.(*State)
+		gains[child] = s.MoveSEE(sc.Eval, child)
+		if gains[child] >= 0 || s.promotion(child) {
+			children = append(children, child)
+		}
 	}
+	sort.SliceStable(children, func(i, j int) bool {
+		return gains[children[i]] > gains[children[j]]
+	})
+
+	for _, child := range children {
+		value := -child.Quiesce(sc, -beta, -alpha)
+		if value >= beta {
+			return value
+		}
+		if value > alpha {
+			alpha = value
+		}
+	}
+
+	return alpha
+}
+
+// TerminalValue() is the value of a state with no legal moves, ply moves
+// from the root: checkmate if the player to move is in check and a draw
+// (stalemate) otherwise.
+func (s *State) TerminalValue(ply int) int {
+	if s.InCheck() {
+		return -(Mate - ply)
+	}
+	return 0
+}
+
+// Value() is the State evaluation function, which returns an integer (with
+// the evaluator's weights).
+func (s *State) Value(e *Evaluator) int {
+	value := 0
+
+	value += s.MaterialAdvantage(e)
+	value += s.PositionalAdvantage(e)
 
 	return value
 }
@@ -112,8 +445,8 @@ func (s *State) PositionAppeal() int {
 // MaterialAdvantage() is one element of the evaluation function which
 // returns an integer expressing the favorability of the material on the
 // board (regardless of its location on the board).
-func (s *State) MaterialAdvantage() int {
-	value, bishops, enemyBishops := 0, 0, 0
+func (s *State) MaterialAdvantage(e *Evaluator) int {
+	value := 0
 	king, enemyKing := false, false
 	player := s.GetToMove()
 
@@ -122,18 +455,14 @@ func (s *State) MaterialAdvantage() int {
 			color := s.GetColor(i, j)
 			if color == player {
 				piece := s.GetPiece(i, j)
-				value += MaterialValue(piece)
-				if piece == Bishop {
-					bishops++
-				} else if piece == King {
+				value += e.Params.PieceValue[piece]
+				if piece == King {
 					king = true
 				}
 			} else if color == Opponent(player) {
 				piece := s.GetPiece(i, j)
-				value -= MaterialValue(piece)
-				if piece == Bishop {
-					enemyBishops++
-				} else if piece == King {
+				value -= e.Params.PieceValue[piece]
+				if piece == King {
 					enemyKing = true
 				}
 			}
@@ -141,38 +470,60 @@ func (s *State) MaterialAdvantage() int {
 	}
 
 	if !king {
-		return NegInfinity
+		return -Mate
 	}
 	if !enemyKing {
-		return PosInfinity
+		return Mate
 	}
 
-	if bishops > 1 {
-		value += 040
-	}
-	if enemyBishops > 1 {
-		value -= 040
+	return value
+}
+
+// MaterialScore() returns the material of the given player, as an
+// evaluation term (it's the same in the middlegame and the endgame).
+func (s *State) MaterialScore(e *Evaluator, player Color) (mg, eg int) {
+	for i := 0; i < 8; i++ {
+		for j := 0; j < 8; j++ {
+			if s.GetColor(i, j) == player {
+				mg += e.Params.PieceValue[s.GetPiece(i, j)]
+			}
+		}
 	}
 
-	return value
+	return mg, mg
 }
 
-// MaterialValue() defines the value of each Piece
+// MaterialValue() defines the value of each Piece (with the default
+// weights)
 func MaterialValue(piece Piece) int {
-	switch (piece) {
-	case Pawn:
-		return 0100
-	case Knight:
-		return 0300
-	case Bishop:
-		return 0300
-	case Rook:
-		return 0500
-	case Queen:
-		return 01100
+	return Params.PieceValue[piece]
+}
+
+// IsMateScore() returns true iff the given score announces a forced mate
+// (for either side).
+func IsMateScore(score int) bool {
+	return score > Mate - MaxPly || score < -(Mate - MaxPly)
+}
+
+// MateDistance() returns the number of moves (not plies) until mate for a
+// mate score. It is positive if the side the score belongs to is mating
+// and negative if it is getting mated.
+func MateDistance(score int) int {
+	if score > 0 {
+		return (Mate - score + 1) / 2
 	}
+	return -(Mate + score + 1) / 2
+}
 
-	return 0
+// Centipawns() converts an evaluation to hundredths of a pawn.
+func Centipawns(score int) int {
+	return DefaultEvaluator.Centipawns(score)
+}
+
+// Centipawns() converts an evaluation with the evaluator's weights to
+// hundredths of a pawn.
+func (e *Evaluator) Centipawns(score int) int {
+	return score * 100 / e.Params.PieceValue[Pawn]
 }
 
 // UCTSearch() is the UCT algorithm
@@ -0,0 +1,104 @@
+// Copyright 2013 Chad Williamson.
+
+// This file is part of Turgenev, a chess program.
+
+// Turgenev is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Turgenev is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License along
+// with Turgenev. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+// For the purposes of exchanges, a king is worth far more than anything it
+// could capture, so it never recaptures onto a defended square.
+const seeKingValue = 1 << 16
+
+// SEE() is the static exchange evaluation of the capture of whatever is on
+// (toRow, toCol) by the piece on (fromRow, fromCol): the material the
+// player to move can expect to win if both sides keep recapturing on that
+// square with their least valuable pieces, each free to stop whenever
+// carrying on would lose material. Pieces lined up behind the capturers
+// (x-rays) join in as the pieces in front of them leave. The pieces are
+// valued with the evaluator's weights.
+func (s *State) SEE(e *Evaluator, fromRow, fromCol, toRow, toCol int) int {
+	var gain [32]int
+	cs := CopyState(s)
+
+	victim := seeValue(e, s.GetPiece(toRow, toCol))
+	if s.GetPiece(fromRow, fromCol) == Pawn && s.GetPiece(toRow, toCol) == Empty &&
+	   fromCol != toCol {
+		// en passant
+		victim = seeValue(e, Pawn)
+		cs.ClearSquare(fromRow, toCol)
+	}
+
+	gain[0] = victim
+	attacker := seeValue(e, s.GetPiece(fromRow, fromCol))
+	cs.ClearSquare(fromRow, fromCol)
+	side, d := Opponent(s.GetToMove()), 0
+
+	for d + 1 < len(gain) {
+		row, col, found := cs.leastValuableAttacker(e, toRow, toCol, side)
+		if !found {
+			break
+		}
+
+		d++
+		gain[d] = attacker - gain[d - 1]
+		attacker = seeValue(e, cs.GetPiece(row, col))
+		cs.ClearSquare(row, col)
+		side = Opponent(side)
+	}
+
+	// Each side may decline to recapture, so work backwards, letting the
+	// side to move at each step take the better of stopping and carrying on.
+	for ; d > 0; d-- {
+		if gain[d] > -gain[d - 1] {
+			gain[d - 1] = -gain[d]
+		}
+	}
+
+	return gain[0]
+}
+
+// MoveSEE() is SEE() for the move from s to its successor t (which had
+// better be a capture).
+func (s *State) MoveSEE(e *Evaluator, t *State) int {
+	r1, c1, r2, c2 := MoveSquares(s, t)
+	return s.SEE(e, r1, c1, r2, c2)
+}
+
+// Return the square of the given player's least valuable piece attacking
+// (row, col).
+func (s *State) leastValuableAttacker(e *Evaluator, row, col int, player Color) (r, c int, found bool) {
+	target, best := squareBit(row, col), 0
+
+	for i := 0; i < 8; i++ {
+		for j := 0; j < 8; j++ {
+			if s.GetColor(i, j) != player || s.AttackSet(i, j) & target == 0 {
+				continue
+			}
+			if value := seeValue(e, s.GetPiece(i, j)); !found || value < best {
+				r, c, best, found = i, j, value, true
+			}
+		}
+	}
+
+	return
+}
+
+// Return the value of a piece for exchange purposes
+func seeValue(e *Evaluator, piece Piece) int {
+	if piece == King {
+		return seeKingValue
+	}
+	return e.Params.PieceValue[piece]
+}
@@ -0,0 +1,147 @@
+// Copyright 2013 Chad Williamson.
+
+// This file is part of Turgenev, a chess program.
+
+// Turgenev is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Turgenev is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License along
+// with Turgenev. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"os"
+)
+
+// An SPRT is a sequential probability ratio test of the hypothesis H1 that
+// the first player is Elo1 stronger than the second against the hypothesis
+// H0 that it's only Elo0 stronger, with the given chances of accepting H1
+// when H0 is true (Alpha) and H0 when H1 is true (Beta).
+type SPRT struct {
+	Elo0, Elo1 float64
+	Alpha, Beta float64
+}
+
+// Bounds() returns the log-likelihood ratios at which H0 and H1 are
+// accepted.
+func (t SPRT) Bounds() (lower, upper float64) {
+	return math.Log(t.Beta / (1 - t.Alpha)), math.Log((1 - t.Beta) / t.Alpha)
+}
+
+// LLR() returns the log-likelihood ratio of H1 to H0 given a score, using
+// the usual normal approximation to the distribution of the score per game
+// (with the draws in it). While there are no wins, losses or draws, half a
+// game of each is added, lest one-sided results look certain (or, with no
+// variance at all, say nothing).
+func (t SPRT) LLR(m MatchScore) float64 {
+	if m.Games() == 0 {
+		return 0
+	}
+
+	wins, losses, draws := float64(m.Wins), float64(m.Losses), float64(m.Draws)
+	if m.Wins == 0 || m.Losses == 0 || m.Draws == 0 {
+		wins, losses, draws = wins + 0.5, losses + 0.5, draws + 0.5
+	}
+	n := wins + losses + draws
+	p := (wins + draws / 2) / n
+	variance := (wins * (1 - p) * (1 - p) + losses * p * p + draws * (0.5 - p) * (0.5 - p)) / n
+
+	p0, p1 := scoreFromElo(t.Elo0), scoreFromElo(t.Elo1)
+	return n * (p1 - p0) * (2 * p - p0 - p1) / (2 * variance)
+}
+
+// Return the expected score of a player the given number of Elo points
+// stronger than its opponent
+func scoreFromElo(elo float64) float64 {
+	return 1 / (1 + math.Pow(10, -elo / 400))
+}
+
+// Decision() returns "H0" or "H1" if the score lets the test accept that
+// hypothesis, or "" if it needs more games.
+func (t SPRT) Decision(m MatchScore) string {
+	lower, upper := t.Bounds()
+	switch llr := t.LLR(m); {
+	case llr <= lower:
+		return "H0"
+	case llr >= upper:
+		return "H1"
+	}
+	return ""
+}
+
+// Sprt() is the "sprt" subcommand, which plays games between two
+// configurations of Turgenev or external engines (set up as for "match")
+// until an SPRT accepts one of its hypotheses, or a maximum number of games
+// have been played.
+func Sprt(args []string) int {
+	var options MatchOptions
+	var test SPRT
+	flags := flag.NewFlagSet("sprt", flag.ExitOnError)
+	flags.Float64Var(&test.Elo0, "elo0", 0, "Elo difference of H0")
+	flags.Float64Var(&test.Elo1, "elo1", 5, "Elo difference of H1")
+	flags.Float64Var(&test.Alpha, "alpha", 0.05, "chance of accepting H1 when H0 is true")
+	flags.Float64Var(&test.Beta, "beta", 0.05, "chance of accepting H0 when H1 is true")
+	maxGames := flags.Int("maxgames", 0, "give up after this many games (0 for no limit)")
+	options.addFlags(flags)
+	flags.Parse(args)
+
+	if test.Elo1 <= test.Elo0 || test.Alpha <= 0 || test.Alpha >= 1 ||
+	   test.Beta <= 0 || test.Beta >= 1 {
+		fmt.Fprintln(os.Stderr, "sprt: need elo0 < elo1 and alpha and beta between 0 and 1")
+		return 2
+	}
+
+	players, openings, err := options.setup()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "sprt:", err)
+		return 1
+	}
+	defer options.close(players)
+
+	lower, upper := test.Bounds()
+	fmt.Printf("SPRT of %s vs %s: H0 elo %g, H1 elo %g, alpha %g, beta %g (LLR bounds %.2f, %.2f)\n\n",
+		   players[0].Name(), players[1].Name(), test.Elo0, test.Elo1, test.Alpha,
+		   test.Beta, lower, upper)
+
+	var score MatchScore
+	decision := ""
+	played := PlayMatch(players[0], players[1], *maxGames, options.concurrency, openings,
+			    options.adj, func(i int, g *PGNGame) bool {
+		if decision != "" {
+			return true
+		}
+		score.Add(g.Result, firstPlayerColor(i))
+		decision = test.Decision(score)
+		fmt.Printf("Game %d: %s -- %s, LLR %.2f\n", i + 1, g.Result, score, test.LLR(score))
+		return decision != ""
+	})
+
+	switch decision {
+	case "H0":
+		fmt.Printf("\nH0 accepted: %s isn't %g Elo stronger than %s.\n",
+			   players[0].Name(), test.Elo1, players[1].Name())
+	case "H1":
+		fmt.Printf("\nH1 accepted: %s is more than %g Elo stronger than %s.\n",
+			   players[0].Name(), test.Elo0, players[1].Name())
+	default:
+		fmt.Printf("\nNo decision after %d games.\n", score.Games())
+	}
+	fmt.Printf("%s, LLR %.2f\n", score, test.LLR(score))
+
+	if err := options.save(played); err != nil {
+		fmt.Fprintln(os.Stderr, "sprt:", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,1256 @@
+// Copyright 2013 Chad Williamson.
+
+// This file is part of Turgenev, a chess program.
+
+// Turgenev is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Turgenev is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License along
+// with Turgenev. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Syzygy endgame tablebases come in pairs of files per material balance,
+// e.g. KRvK.rtbw and KRvK.rtbz. The WDL file tells whether a position is
+// won, drawn or lost, which is all the search needs, and the DTZ file
+// gives the distance to the next capture or pawn move (the "zeroing" moves
+// that reset the fifty-move counter) along a winning line, which lets the
+// root play the win out. The format and the probing code follow the
+// generator's own (Ronald de Man's) as Stockfish and Fathom implement it.
+
+// Results of a WDL probe, for the player to move. Cursed wins and blessed
+// losses are the ones the fifty-move rule turns into draws.
+const (
+	WDLLoss = -2
+	WDLBlessedLoss = -1
+	WDLDraw = 0
+	WDLCursedWin = 1
+	WDLWin = 2
+)
+
+// Tablebase settings. Positions are only probed if they have no castling
+// rights and at most TablebasePieces pieces (the most in any table found
+// under SyzygyPath). With Syzygy50MoveRule, cursed wins and blessed losses
+// are scored as draws.
+var (
+	SyzygyPath string = ""
+	Syzygy50MoveRule bool = true
+	TablebasePieces int = 0
+)
+
+// Names of the engine options for the tablebases
+const (
+	SyzygyPathOption = "SyzygyPath"
+	Syzygy50MoveRuleOption = "Syzygy50MoveRule"
+)
+
+// A tablebase win scores this, less the distance from the root: more than
+// any evaluation, but less than a mate.
+const TablebaseWin = Mate - 2 * MaxPly
+
+// The tables loaded from SyzygyPath, by material signature ("KRvK"). Each
+// table is entered under the signatures for both colorings.
+var (
+	tablebases = make(map[string]*tbEntry)
+	tablebaseLock sync.Mutex
+)
+
+const tbMaxPieces = 7
+
+// Outcome of looking a position up in a table
+type tbResult int
+
+const (
+	tbFail tbResult = iota
+	tbOK
+	tbChangeSTM // the DTZ table only has the other player to move
+	tbZeroingBestMove // the best move is a capture or pawn move
+)
+
+// Flags of a table's pairs data. Those below tbSingleValue only matter for
+// DTZ tables.
+const (
+	tbSTM = 1
+	tbMapped = 2
+	tbWinPlies = 4
+	tbLossPlies = 8
+	tbWide = 16
+	tbSingleValue = 128
+)
+
+var (
+	tbWDLMagic = []byte{0x71, 0xE8, 0x23, 0x5D}
+	tbDTZMagic = []byte{0xD7, 0x66, 0x0C, 0xA5}
+)
+
+// A tbEntry describes a material balance and holds its WDL and DTZ tables.
+// Key is the signature with the stronger side (the one the files are named
+// for) as White, and key2 the one with the colors swapped.
+type tbEntry struct {
+	key, key2 string
+	pieceCount int
+	hasPawns bool
+	hasUniquePieces bool
+
+	// Pawns of the leading color (the side with fewer pawns, if both have
+	// some) and of the other
+	pawnCount [2]int
+
+	wdl, dtz tbTable
+}
+
+// A tbTable is one file of a tablebase, read when it's first probed. Its
+// pairs data is indexed by the player to move (relative to the stronger
+// side) and, for tables with pawns, by the file of the leading pawn.
+type tbTable struct {
+	path string
+	dtz bool
+	loaded, ok bool
+	data []byte
+	sides int
+	dtzMap int
+	pairs [2][4]tbPairs
+}
+
+// tbPairs is the description of one of a table's compressed subtables: how
+// positions are mapped to indices and how to decode the value at an index.
+// The ints that aren't counts are offsets into the table's data.
+type tbPairs struct {
+	data []byte
+	flags byte
+	pieces [tbMaxPieces]byte
+	groupLen [tbMaxPieces + 1]int
+	groupIdx [tbMaxPieces + 1]uint64
+
+	sizeofBlock, span uint64
+	numBlocks, blockLengthSize, sparseIndexSize int
+	minSymLen, maxSymLen int
+	lowestSym, btree int
+	base64 []uint64
+	symlen []int
+
+	sparseIndex, blockLength, blocks int
+	mapIdx [4]int
+}
+
+// Tables for indexing positions
+var (
+	tbMapPawns [64]int
+	tbMapB1H1H7 [64]int
+	tbMapA1D1D4 [64]int
+	tbMapKK [10][64]int
+	tbBinomial [6][64]uint64
+	tbLeadPawnIdx [6][64]uint64
+	tbLeadPawnsSize [6][4]uint64
+)
+
+func init() {
+	// The squares below the a1-h8 diagonal are numbered 0 to 27.
+	code := 0
+	for sq := 0; sq < 64; sq++ {
+		if offA1H8(sq) < 0 {
+			tbMapB1H1H7[sq] = code
+			code++
+		}
+	}
+
+	// The a1-d1-d4 triangle is numbered 0 to 9, the diagonal last.
+	code = 0
+	var diagonal []int
+	for _, sq := range []int{0, 1, 2, 3, 8, 9, 10, 11, 16, 17, 18, 19, 24, 25, 26, 27} {
+		if offA1H8(sq) < 0 {
+			tbMapA1D1D4[sq] = code
+			code++
+		} else if offA1H8(sq) == 0 {
+			diagonal = append(diagonal, sq)
+		}
+	}
+	for _, sq := range diagonal {
+		tbMapA1D1D4[sq] = code
+		code++
+	}
+
+	// The 462 legal placements of two kings with the first in the
+	// triangle (and the second not above the diagonal if the first is on
+	// it), with both on the diagonal last
+	code = 0
+	var bothOnDiagonal [][2]int
+	for idx := 0; idx < 10; idx++ {
+		for sq1 := 0; sq1 < 28; sq1++ {
+			if tbMapA1D1D4[sq1] != idx || (idx == 0 && sq1 != 1) {
+				continue
+			}
+			for sq2 := 0; sq2 < 64; sq2++ {
+				dr, dc := sq1 >> 3 - sq2 >> 3, sq1 & 7 - sq2 & 7
+				switch {
+				case dr >= -1 && dr <= 1 && dc >= -1 && dc <= 1:
+				case offA1H8(sq1) == 0 && offA1H8(sq2) > 0:
+				case offA1H8(sq1) == 0 && offA1H8(sq2) == 0:
+					bothOnDiagonal = append(bothOnDiagonal, [2]int{idx, sq2})
+				default:
+					tbMapKK[idx][sq2] = code
+					code++
+				}
+			}
+		}
+	}
+	for _, p := range bothOnDiagonal {
+		tbMapKK[p[0]][p[1]] = code
+		code++
+	}
+
+	tbBinomial[0][0] = 1
+	for n := 1; n < 64; n++ {
+		for k := 0; k < 6 && k <= n; k++ {
+			if k > 0 {
+				tbBinomial[k][n] += tbBinomial[k - 1][n - 1]
+			}
+			if k < n {
+				tbBinomial[k][n] += tbBinomial[k][n - 1]
+			}
+		}
+	}
+
+	// Pawns are numbered from the edges in, so the leading pawn (the one
+	// with the highest number) is the one nearest an edge and lowest.
+	available := 47
+	for lead := 1; lead <= 5; lead++ {
+		for f := 0; f < 4; f++ {
+			idx := uint64(0)
+			for r := 1; r <= 6; r++ {
+				sq := r << 3 + f
+				if lead == 1 {
+					tbMapPawns[sq] = available
+					tbMapPawns[sq ^ 7] = available - 1
+					available -= 2
+				}
+				tbLeadPawnIdx[lead][sq] = idx
+				idx += tbBinomial[lead - 1][tbMapPawns[sq]]
+			}
+			tbLeadPawnsSize[lead][f] = idx
+		}
+	}
+}
+
+// Return how far below (negative) or above the a1-h8 diagonal a square is
+func offA1H8(sq int) int {
+	return sq >> 3 - sq & 7
+}
+
+// SetSyzygyPath() looks for tablebase files in the directories listed in
+// path (separated as in $PATH). An empty path turns the tablebases off.
+func SetSyzygyPath(path string) error {
+	tablebaseLock.Lock()
+	defer tablebaseLock.Unlock()
+
+	tablebases, TablebasePieces, SyzygyPath = make(map[string]*tbEntry), 0, path
+	if path == "" {
+		return nil
+	}
+
+	for _, dir := range filepath.SplitList(path) {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+
+		for _, f := range files {
+			code := strings.TrimSuffix(f.Name(), ".rtbw")
+			if code == f.Name() || !validTablebaseCode(code) {
+				continue
+			}
+			if _, ok := tablebases[code]; ok {
+				continue
+			}
+
+			e := newTablebaseEntry(code)
+			e.wdl.path = filepath.Join(dir, f.Name())
+			e.dtz.path = filepath.Join(dir, code + ".rtbz")
+			e.dtz.dtz = true
+			tablebases[e.key], tablebases[e.key2] = e, e
+			if e.pieceCount > TablebasePieces {
+				TablebasePieces = e.pieceCount
+			}
+		}
+	}
+
+	return nil
+}
+
+// SetTablebaseOption() handles the engine options for the tablebases,
+// returning false if name isn't one of them.
+func SetTablebaseOption(name, value string) (bool, error) {
+	var err error
+
+	switch name {
+	case SyzygyPathOption:
+		err = SetSyzygyPath(value)
+	case Syzygy50MoveRuleOption:
+		Syzygy50MoveRule, err = strconv.ParseBool(value)
+	default:
+		return false, nil
+	}
+
+	return true, err
+}
+
+// Return true iff code is a material signature like "KRPvKR"
+func validTablebaseCode(code string) bool {
+	sides := strings.Split(code, "v")
+	if len(sides) != 2 || len(code) - 1 > tbMaxPieces {
+		return false
+	}
+
+	for _, side := range sides {
+		if len(side) == 0 || side[0] != 'K' ||
+		   strings.Trim(side[1:], "QRBNP") != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// Return the entry for the tables named by code
+func newTablebaseEntry(code string) *tbEntry {
+	sides := strings.Split(code, "v")
+	e := &tbEntry{key: code, key2: sides[1] + "v" + sides[0]}
+	e.pieceCount = len(code) - 1
+
+	for _, side := range sides {
+		for _, r := range "QRBNP" {
+			if strings.Count(side, string(r)) == 1 {
+				e.hasUniquePieces = true
+			}
+		}
+	}
+
+	// The leading color is the one with fewer pawns, if both have some.
+	white, black := strings.Count(sides[0], "P"), strings.Count(sides[1], "P")
+	e.hasPawns = white + black > 0
+	if black == 0 || (white > 0 && black >= white) {
+		e.pawnCount = [2]int{white, black}
+	} else {
+		e.pawnCount = [2]int{black, white}
+	}
+
+	return e
+}
+
+// Return the material signature of s, with White's pieces first
+func (s *State) materialKey() string {
+	var b strings.Builder
+
+	for _, player := range []Color{White, Black} {
+		if player == Black {
+			b.WriteByte('v')
+		}
+		for _, piece := range []Piece{King, Queen, Rook, Bishop, Knight, Pawn} {
+			for i := 0; i < 64; i++ {
+				if Piece(s.board[i] & pieceMask) == piece &&
+				   Color((s.board[i] & colorMask) >> 3) == player {
+					b.WriteByte(" PNBRQK"[piece])
+				}
+			}
+		}
+	}
+
+	return b.String()
+}
+
+// TablebaseEligible() returns true iff s can be looked up in the loaded
+// tablebases.
+func (s *State) TablebaseEligible() bool {
+	return TablebasePieces > 0 &&
+	       popCount(s.occupiedBy(White) | s.occupiedBy(Black)) <= TablebasePieces &&
+	       s.CastlingRights() == ""
+}
+
+// ProbeWDL() returns the result of s for the player to move according to
+// the WDL tables, and false if they don't have it.
+func (s *State) ProbeWDL() (int, bool) {
+	if !s.TablebaseEligible() {
+		return 0, false
+	}
+
+	wdl, result := s.tbSearch(false)
+	return wdl, result != tbFail
+}
+
+// ProbeDTZ() returns the distance to zeroing of s according to the DTZ
+// tables, in plies: positive if the player to move wins, negative if it
+// loses and 0 for a draw. Values beyond 100 are cursed wins or blessed
+// losses. The second result is false if the tables don't have s.
+func (s *State) ProbeDTZ() (int, bool) {
+	if !s.TablebaseEligible() {
+		return 0, false
+	}
+
+	dtz, result := s.probeDTZ()
+	return dtz, result != tbFail
+}
+
+// TablebaseResult() returns the result of s for the player to move along
+// with its DTZ. Unlike ProbeWDL(), it takes the halfmove clock into account:
+// with Syzygy50MoveRule, a win whose next capture or pawn move would come
+// after the fifty moves are up is only a cursed win (and the loss a blessed
+// one). It returns false if the tables don't have s.
+func (s *State) TablebaseResult() (wdl, dtz int, ok bool) {
+	if dtz, ok = s.ProbeDTZ(); !ok {
+		return 0, 0, false
+	}
+
+	clock := 0
+	if Syzygy50MoveRule {
+		clock = s.HalfmoveClock()
+	}
+	switch {
+	case dtz > 0 && dtz + clock <= 100:
+		wdl = WDLWin
+	case dtz > 0:
+		wdl = WDLCursedWin
+	case dtz < 0 && -dtz + clock <= 100:
+		wdl = WDLLoss
+	case dtz < 0:
+		wdl = WDLBlessedLoss
+	}
+	return wdl, dtz, true
+}
+
+// TablebaseValue() converts a WDL result into a search score for a position
+// ply moves from the root.
+func TablebaseValue(wdl, ply int) int {
+	draw := 0
+	if Syzygy50MoveRule {
+		draw = 1
+	}
+
+	switch {
+	case wdl > draw:
+		return TablebaseWin - ply
+	case wdl < -draw:
+		return -(TablebaseWin - ply)
+	}
+	return 2 * wdl * draw
+}
+
+// TablebaseMove() returns the tablebase-perfect successor of s, or nil if s
+// isn't in the tables. Winning moves that reach the next capture or pawn
+// move soonest are preferred, and losing moves that put it off longest.
+func TablebaseMove(s *State) *State {
+	if !s.TablebaseEligible() {
+		return nil
+	}
+
+	const maxRank = 1 << 16
+	var best *State
+	bestRank := -2 * maxRank
+
+	for e := s.LegalSuccessors().Front(); e != nil; e = e.Next() {
+		t := e.Value.(*State)
+
+		var dtz int
+		var result tbResult
+		if s.zeroing(t) {
+			var wdl int
+			wdl, result = t.tbSearch(false)
+			dtz = dtzBeforeZeroing(-wdl)
+		} else {
+			dtz, result = t.probeDTZ()
+			dtz = -dtz
+			if dtz > 0 {
+				dtz++
+			} else if dtz < 0 {
+				dtz--
+			}
+		}
+		if result == tbFail {
+			return nil
+		}
+
+		// A mate is as good as it gets.
+		if dtz == 2 && !t.HasLegalMove() && t.InCheck() {
+			dtz = 1
+		}
+
+		rank := 0
+		if dtz > 0 {
+			rank = maxRank - dtz
+		} else if dtz < 0 {
+			rank = -maxRank - dtz
+		}
+		if rank > bestRank {
+			best, bestRank = t, rank
+		}
+	}
+
+	return best
+}
+
+// Return true iff the move from s to t captures or moves a pawn
+func (s *State) zeroing(t *State) bool {
+	r1, c1, _, _ := MoveSquares(s, t)
+	return s.GetPiece(r1, c1) == Pawn || s.capture(t)
+}
+
+// Return true iff the move from s to t captures a piece
+func (s *State) capture(t *State) bool {
+	enemy := Opponent(s.GetToMove())
+	return popCount(t.occupiedBy(enemy)) < popCount(s.occupiedBy(enemy))
+}
+
+// Return the DTZ of a position whose best move is a zeroing one with the
+// given result
+func dtzBeforeZeroing(wdl int) int {
+	switch wdl {
+	case WDLWin:
+		return 1
+	case WDLCursedWin:
+		return 101
+	case WDLBlessedLoss:
+		return -101
+	case WDLLoss:
+		return -1
+	}
+	return 0
+}
+
+// The tables are free to store anything for positions where the player to
+// move has a winning capture (and the DTZ tables for a winning pawn move,
+// or when the best move is en passant), so a probe has to look at those
+// moves and take the best of them and the stored result. With
+// checkZeroing, pawn moves are looked at too and the result is
+// tbZeroingBestMove when one of those moves is best.
+func (s *State) tbSearch(checkZeroing bool) (int, tbResult) {
+	bestValue, moves, looked := WDLLoss, 0, 0
+
+	for e := s.LegalSuccessors().Front(); e != nil; e = e.Next() {
+		t := e.Value.(*State)
+		moves++
+		if !s.capture(t) && !(checkZeroing && s.zeroing(t)) {
+			continue
+		}
+		looked++
+
+		value, result := t.tbSearch(false)
+		if result == tbFail {
+			return WDLDraw, tbFail
+		}
+		value = -value
+
+		if value > bestValue {
+			bestValue = value
+			if value >= WDLWin {
+				return value, tbZeroingBestMove
+			}
+		}
+	}
+
+	// If every move has been looked at, the stored value (which could
+	// be wrong, e.g. with en passant possible) isn't needed.
+	value, noMoreMoves := bestValue, looked > 0 && looked == moves
+	if !noMoreMoves {
+		var result tbResult
+		value, result = s.probeTable(false, WDLDraw)
+		if result == tbFail {
+			return WDLDraw, tbFail
+		}
+	}
+
+	if bestValue >= value {
+		if bestValue > WDLDraw || noMoreMoves {
+			return bestValue, tbZeroingBestMove
+		}
+		return bestValue, tbOK
+	}
+	return value, tbOK
+}
+
+// Return the DTZ of s as ProbeDTZ() does, without checking eligibility
+func (s *State) probeDTZ() (int, tbResult) {
+	wdl, result := s.tbSearch(true)
+	if result == tbFail || wdl == WDLDraw {
+		return 0, result
+	}
+	if result == tbZeroingBestMove {
+		return dtzBeforeZeroing(wdl), result
+	}
+
+	dtz, result := s.probeTable(true, wdl)
+	if result == tbFail {
+		return 0, result
+	}
+	if result != tbChangeSTM {
+		if wdl == WDLBlessedLoss || wdl == WDLCursedWin {
+			dtz += 100
+		}
+		if wdl < 0 {
+			dtz = -dtz
+		}
+		return dtz, result
+	}
+
+	// The table only has the other player to move, so look a ply ahead
+	// for the winning move that minimizes the DTZ.
+	minDTZ := 0xFFFF
+	for e := s.LegalSuccessors().Front(); e != nil; e = e.Next() {
+		t := e.Value.(*State)
+
+		if s.zeroing(t) {
+			var value int
+			value, result = t.tbSearch(false)
+			dtz = -dtzBeforeZeroing(value)
+		} else {
+			dtz, result = t.probeDTZ()
+			dtz = -dtz
+			if dtz > 0 {
+				dtz++
+			} else if dtz < 0 {
+				dtz--
+			}
+		}
+		if result == tbFail {
+			return 0, result
+		}
+
+		if dtz == 2 && t.InCheck() && !t.HasLegalMove() {
+			minDTZ = 1
+		}
+		if dtz < minDTZ && (dtz > 0) == (wdl > 0) && dtz != 0 {
+			minDTZ = dtz
+		}
+	}
+
+	// Without legal moves, the position is mate.
+	if minDTZ == 0xFFFF {
+		return -1, tbOK
+	}
+	return minDTZ, tbOK
+}
+
+// Look s up in its WDL or DTZ table. A DTZ lookup needs the WDL result to
+// interpret the stored value.
+func (s *State) probeTable(dtz bool, wdl int) (int, tbResult) {
+	if popCount(s.occupiedBy(White) | s.occupiedBy(Black)) == 2 {
+		return WDLDraw, tbOK
+	}
+
+	tablebaseLock.Lock()
+	e := tablebases[s.materialKey()]
+	t := (*tbTable)(nil)
+	if e != nil {
+		t = &e.wdl
+		if dtz {
+			t = &e.dtz
+		}
+		t.load(e)
+	}
+	tablebaseLock.Unlock()
+
+	if t == nil || !t.ok {
+		return 0, tbFail
+	}
+	return e.probe(s, t, wdl)
+}
+
+// Read the table's file and set up its pairs data, if that hasn't already
+// been tried. A table that can't be read is marked as not ok.
+func (t *tbTable) load(e *tbEntry) {
+	if t.loaded {
+		return
+	}
+	t.loaded = true
+
+	data, err := ioutil.ReadFile(t.path)
+	if err != nil {
+		return
+	}
+	magic := tbWDLMagic
+	if t.dtz {
+		magic = tbDTZMagic
+	}
+	if len(data) < 5 || string(data[:4]) != string(magic) {
+		return
+	}
+
+	t.data = data
+	t.ok = t.setup(e)
+	if !t.ok {
+		t.data = nil
+	}
+}
+
+// Return the pairs data for the given player to move and leading file
+func (t *tbTable) get(stm, file int) *tbPairs {
+	return &t.pairs[stm % t.sides][file]
+}
+
+// Parse the table's header. Returns false if the file is malformed.
+func (t *tbTable) setup(e *tbEntry) (ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+
+	data, p := t.data, 4
+	const split, hasPawns = 1, 2
+	if (data[p] & hasPawns != 0) != e.hasPawns ||
+	   (data[p] & split != 0) != (e.key != e.key2) {
+		return false
+	}
+	p++
+
+	t.sides = 1
+	if !t.dtz && e.key != e.key2 {
+		t.sides = 2
+	}
+	files := 1
+	if e.hasPawns {
+		files = 4
+	}
+	pp := e.hasPawns && e.pawnCount[1] > 0
+
+	for f := 0; f < files; f++ {
+		order := [2][2]int{{int(data[p] & 0xF), 0xF}, {int(data[p] >> 4), 0xF}}
+		if pp {
+			order[0][1], order[1][1] = int(data[p + 1] & 0xF), int(data[p + 1] >> 4)
+		}
+		p += 1 + boolInt(pp)
+
+		for k := 0; k < e.pieceCount; k, p = k + 1, p + 1 {
+			t.pairs[0][f].pieces[k] = data[p] & 0xF
+			t.pairs[1][f].pieces[k] = data[p] >> 4
+		}
+		for i := 0; i < t.sides; i++ {
+			t.pairs[i][f].data = data
+			t.pairs[i][f].setGroups(e, order[i], f)
+		}
+	}
+	p += p & 1
+
+	for f := 0; f < files; f++ {
+		for i := 0; i < t.sides; i++ {
+			p = t.pairs[i][f].setSizes(p)
+		}
+	}
+
+	if t.dtz {
+		t.dtzMap = p
+		for f := 0; f < files; f++ {
+			p = t.pairs[0][f].setDTZMap(p, t.dtzMap)
+		}
+		p += p & 1
+	}
+
+	for f := 0; f < files; f++ {
+		for i := 0; i < t.sides; i++ {
+			t.pairs[i][f].sparseIndex = p
+			p += 6 * t.pairs[i][f].sparseIndexSize
+		}
+	}
+	for f := 0; f < files; f++ {
+		for i := 0; i < t.sides; i++ {
+			t.pairs[i][f].blockLength = p
+			p += 2 * t.pairs[i][f].blockLengthSize
+		}
+	}
+	for f := 0; f < files; f++ {
+		for i := 0; i < t.sides; i++ {
+			d := &t.pairs[i][f]
+			p = (p + 0x3F) &^ 0x3F
+			d.blocks = p
+			p += d.numBlocks * int(d.sizeofBlock)
+		}
+	}
+
+	return p <= len(data)
+}
+
+// Work out the groups of pieces that are encoded together and the factors
+// their indices are multiplied by. The order says which group comes first
+// in the index: the leading pieces or pawns are order[0] and the rest of
+// the pawns (if both sides have some) order[1].
+func (d *tbPairs) setGroups(e *tbEntry, order [2]int, file int) {
+	firstLen := 2
+	if e.hasPawns {
+		firstLen = 0
+	} else if e.hasUniquePieces {
+		firstLen = 3
+	}
+
+	n := 0
+	d.groupLen[0] = 1
+	for i := 1; i < e.pieceCount; i++ {
+		firstLen--
+		if firstLen > 0 || d.pieces[i] == d.pieces[i - 1] {
+			d.groupLen[n]++
+		} else {
+			n++
+			d.groupLen[n] = 1
+		}
+	}
+	n++
+	d.groupLen[n] = 0
+
+	pp := e.hasPawns && e.pawnCount[1] > 0
+	next, free := 1, 64 - d.groupLen[0]
+	if pp {
+		next, free = 2, free - d.groupLen[1]
+	}
+
+	idx := uint64(1)
+	for k := 0; next < n || k == order[0] || k == order[1]; k++ {
+		switch {
+		case k == order[0]:
+			d.groupIdx[0] = idx
+			switch {
+			case e.hasPawns:
+				idx *= tbLeadPawnsSize[d.groupLen[0]][file]
+			case e.hasUniquePieces:
+				idx *= 31332
+			default:
+				idx *= 462
+			}
+		case k == order[1]:
+			d.groupIdx[1] = idx
+			idx *= tbBinomial[d.groupLen[1]][48 - d.groupLen[0]]
+		default:
+			d.groupIdx[next] = idx
+			idx *= tbBinomial[d.groupLen[next]][free]
+			free -= d.groupLen[next]
+			next++
+		}
+	}
+	d.groupIdx[n] = idx
+}
+
+// Read the sizes of the compressed data and the canonical Huffman code it
+// uses, starting at offset p, and return the offset after them.
+func (d *tbPairs) setSizes(p int) int {
+	data := d.data
+	d.flags = data[p]
+	p++
+	if d.flags & tbSingleValue != 0 {
+		d.minSymLen = int(data[p])
+		return p + 1
+	}
+
+	n := 0
+	for d.groupLen[n] != 0 {
+		n++
+	}
+	size := d.groupIdx[n]
+
+	d.sizeofBlock = 1 << data[p]
+	d.span = 1 << data[p + 1]
+	d.sparseIndexSize = int((size + d.span - 1) / d.span)
+	padding := int(data[p + 2])
+	d.numBlocks = int(le32(data, p + 3))
+	d.blockLengthSize = d.numBlocks + padding
+	d.maxSymLen, d.minSymLen = int(data[p + 7]), int(data[p + 8])
+	p += 9
+	d.lowestSym = p
+
+	// Longer codes have lower values, so base64[i] is the smallest code
+	// of length minSymLen + i, left-justified in 64 bits.
+	d.base64 = make([]uint64, d.maxSymLen - d.minSymLen + 1)
+	for i := len(d.base64) - 2; i >= 0; i-- {
+		d.base64[i] = (d.base64[i + 1] + uint64(le16(data, d.lowestSym + 2 * i)) -
+			       uint64(le16(data, d.lowestSym + 2 * (i + 1)))) / 2
+	}
+	for i := range d.base64 {
+		d.base64[i] <<= uint(64 - i - d.minSymLen)
+	}
+	p += 2 * len(d.base64)
+
+	// Each symbol is either a value or a pair of symbols; symlen counts
+	// the values a symbol stands for, less one.
+	d.symlen = make([]int, le16(data, p))
+	p += 2
+	d.btree = p
+	visited := make([]bool, len(d.symlen))
+	for sym := range d.symlen {
+		if !visited[sym] {
+			d.symlen[sym] = d.setSymlen(sym, visited)
+		}
+	}
+
+	return p + 3 * len(d.symlen) + (len(d.symlen) & 1)
+}
+
+// Return the symlen of sym, filling in those of the symbols it pairs
+func (d *tbPairs) setSymlen(sym int, visited []bool) int {
+	visited[sym] = true
+	right := d.right(sym)
+	if right == 0xFFF {
+		return 0
+	}
+
+	left := d.left(sym)
+	if !visited[left] {
+		d.symlen[left] = d.setSymlen(left, visited)
+	}
+	if !visited[right] {
+		d.symlen[right] = d.setSymlen(right, visited)
+	}
+	return d.symlen[left] + d.symlen[right] + 1
+}
+
+// Return the left half of a paired symbol (or the value of a leaf)
+func (d *tbPairs) left(sym int) int {
+	p := d.btree + 3 * sym
+	return int(d.data[p + 1] & 0xF) << 8 | int(d.data[p])
+}
+
+// Return the right half of a paired symbol (0xFFF for a leaf)
+func (d *tbPairs) right(sym int) int {
+	p := d.btree + 3 * sym
+	return int(d.data[p + 2]) << 4 | int(d.data[p + 1] >> 4)
+}
+
+// Note where the DTZ table's value maps for each WDL result start, and
+// return the offset past them.
+func (d *tbPairs) setDTZMap(p, base int) int {
+	if d.flags & tbMapped == 0 {
+		return p
+	}
+
+	if d.flags & tbWide != 0 {
+		p += p & 1
+		for i := 0; i < 4; i++ {
+			d.mapIdx[i] = (p - base) / 2 + 1
+			p += 2 * int(le16(d.data, p)) + 2
+		}
+	} else {
+		for i := 0; i < 4; i++ {
+			d.mapIdx[i] = p - base + 1
+			p += int(d.data[p]) + 1
+		}
+	}
+
+	return p
+}
+
+// Return the value at index idx: find the block holding it with the sparse
+// index, decode Huffman symbols until reaching the one that covers it and
+// then expand the symbol's pairs down to the value.
+func (d *tbPairs) decompress(idx uint64) int {
+	if d.flags & tbSingleValue != 0 {
+		return d.minSymLen
+	}
+	data := d.data
+
+	k := d.sparseIndex + 6 * int(idx / d.span)
+	block := int(le32(data, k))
+	offset := int(le16(data, k + 4)) + int(idx % d.span) - int(d.span / 2)
+
+	blockLength := func(b int) int {
+		return int(le16(data, d.blockLength + 2 * b))
+	}
+	for offset < 0 {
+		block--
+		offset += blockLength(block) + 1
+	}
+	for offset > blockLength(block) {
+		offset -= blockLength(block) + 1
+		block++
+	}
+
+	p := d.blocks + block * int(d.sizeofBlock)
+	buf, bits := be64(data, p), 64
+	p += 8
+
+	var sym int
+	for {
+		n := 0
+		for buf < d.base64[n] {
+			n++
+		}
+		sym = int((buf - d.base64[n]) >> uint(64 - n - d.minSymLen))
+		sym += int(le16(data, d.lowestSym + 2 * n))
+
+		if offset < d.symlen[sym] + 1 {
+			break
+		}
+		offset -= d.symlen[sym] + 1
+
+		n += d.minSymLen
+		buf <<= uint(n)
+		bits -= n
+		if bits <= 32 {
+			bits += 32
+			buf |= uint64(be32(data, p)) << uint(64 - bits)
+			p += 4
+		}
+	}
+
+	for d.symlen[sym] != 0 {
+		left := d.left(sym)
+		if offset < d.symlen[left] + 1 {
+			sym = left
+		} else {
+			offset -= d.symlen[left] + 1
+			sym = d.right(sym)
+		}
+	}
+
+	return d.left(sym)
+}
+
+// Look s up in table t of entry e.
+func (e *tbEntry) probe(s *State, t *tbTable, wdl int) (value int, result tbResult) {
+	defer func() {
+		if recover() != nil {
+			value, result = 0, tbFail
+		}
+	}()
+
+	stm, file, idx, ok := e.index(s, t)
+	if !ok {
+		return 0, tbChangeSTM
+	}
+	return t.mapScore(file, t.get(stm, file).decompress(idx), wdl), tbOK
+}
+
+// Work out where table t of entry e keeps s: the player to move (relative
+// to the stronger side) and leading file that select its pairs data, and
+// the index within them. The position is first turned around, if need be,
+// so that the stronger side is White, and mirrored so that the leading
+// piece or pawn is in the part of the board the table covers; then the
+// pieces are mapped to an index group by group. Returns false if t is a
+// DTZ table that only has the other player to move.
+func (e *tbEntry) index(s *State, t *tbTable) (stm, file int, idx uint64, ok bool) {
+	var squares [tbMaxPieces]int
+	var pieces [tbMaxPieces]byte
+	size, leadPawns := 0, 0
+	var leadPawnSet uint64
+
+	// Tables with the same material for both sides only have White to
+	// move.
+	flip := s.materialKey() != e.key || (e.key == e.key2 && s.GetToMove() == Black)
+	flipColor, flipSquares := byte(0), 0
+	if s.GetToMove() == Black {
+		stm = 1
+	}
+	if flip {
+		flipColor, flipSquares, stm = 8, 56, stm ^ 1
+	}
+
+	if e.hasPawns {
+		lead := t.get(0, 0).pieces[0] ^ flipColor
+		for sq := 0; sq < 64; sq++ {
+			if tbPieceCode(s, sq) == lead {
+				squares[size] = sq ^ flipSquares
+				leadPawnSet |= 1 << uint(sq)
+				size++
+			}
+		}
+		leadPawns = size
+
+		max := 0
+		for i := 1; i < leadPawns; i++ {
+			if tbMapPawns[squares[i]] > tbMapPawns[squares[max]] {
+				max = i
+			}
+		}
+		squares[0], squares[max] = squares[max], squares[0]
+		file = squares[0] & 7
+		if file > 3 {
+			file = 7 - file
+		}
+	}
+
+	if t.dtz && int(t.get(stm, file).flags & tbSTM) != stm &&
+	   !(e.key == e.key2 && !e.hasPawns) {
+		return stm, file, 0, false
+	}
+
+	for sq := 0; sq < 64; sq++ {
+		if leadPawnSet & (1 << uint(sq)) != 0 || s.board[sq] & pieceMask == 0 {
+			continue
+		}
+		squares[size] = sq ^ flipSquares
+		pieces[size] = tbPieceCode(s, sq) ^ flipColor
+		size++
+	}
+
+	// Put the pieces in the table's order.
+	d := t.get(stm, file)
+	for i := leadPawns; i < size - 1; i++ {
+		for j := i + 1; j < size; j++ {
+			if d.pieces[i] == pieces[j] {
+				pieces[i], pieces[j] = pieces[j], pieces[i]
+				squares[i], squares[j] = squares[j], squares[i]
+				break
+			}
+		}
+	}
+
+	if squares[0] & 7 > 3 {
+		for i := 0; i < size; i++ {
+			squares[i] ^= 7
+		}
+	}
+
+	if e.hasPawns {
+		idx = tbLeadPawnIdx[leadPawns][squares[0]]
+		rest := squares[1:leadPawns]
+		sort.SliceStable(rest, func(i, j int) bool {
+			return tbMapPawns[rest[i]] < tbMapPawns[rest[j]]
+		})
+		for i := 1; i < leadPawns; i++ {
+			idx += tbBinomial[i][tbMapPawns[squares[i]]]
+		}
+	} else {
+		idx = d.leadingIndex(e, squares[:size])
+	}
+
+	// The remaining groups, each as a combination of the squares left
+	// over by the groups before it
+	idx *= d.groupIdx[0]
+	first := d.groupLen[0]
+	remainingPawns := e.hasPawns && e.pawnCount[1] > 0
+	for next := 1; d.groupLen[next] != 0; next++ {
+		group := squares[first:first + d.groupLen[next]]
+		sort.Ints(group)
+
+		n := uint64(0)
+		for i, sq := range group {
+			adjust := 0
+			for _, prev := range squares[:first] {
+				if sq > prev {
+					adjust++
+				}
+			}
+			if remainingPawns {
+				adjust += 8
+			}
+			n += tbBinomial[i + 1][sq - adjust]
+		}
+
+		remainingPawns = false
+		idx += n * d.groupIdx[next]
+		first += d.groupLen[next]
+	}
+
+	return stm, file, idx, true
+}
+
+// Return the index of the leading group of a pawnless position: the kings
+// alone, or the first three pieces if there are unique pieces. The squares
+// are mirrored as necessary to bring the first piece into the a1-d1-d4
+// triangle and the first piece off the diagonal below it.
+func (d *tbPairs) leadingIndex(e *tbEntry, squares []int) uint64 {
+	if squares[0] >> 3 > 3 {
+		for i := range squares {
+			squares[i] ^= 56
+		}
+	}
+	for i := 0; i < d.groupLen[0]; i++ {
+		if offA1H8(squares[i]) == 0 {
+			continue
+		}
+		if offA1H8(squares[i]) > 0 {
+			for j := i; j < len(squares); j++ {
+				squares[j] = (squares[j] >> 3 | squares[j] << 3) & 63
+			}
+		}
+		break
+	}
+
+	if !e.hasUniquePieces {
+		return uint64(tbMapKK[tbMapA1D1D4[squares[0]]][squares[1]])
+	}
+
+	sq0, sq1, sq2 := squares[0], squares[1], squares[2]
+	adjust1 := boolInt(sq1 > sq0)
+	adjust2 := boolInt(sq2 > sq0) + boolInt(sq2 > sq1)
+
+	switch {
+	case offA1H8(sq0) != 0:
+		return uint64((tbMapA1D1D4[sq0] * 63 + sq1 - adjust1) * 62 + sq2 - adjust2)
+	case offA1H8(sq1) != 0:
+		return uint64((6 * 63 + (sq0 >> 3) * 28 + tbMapB1H1H7[sq1]) * 62 + sq2 - adjust2)
+	case offA1H8(sq2) != 0:
+		return uint64(6 * 63 * 62 + 4 * 28 * 62 + (sq0 >> 3) * 7 * 28 +
+			      (sq1 >> 3 - adjust1) * 28 + tbMapB1H1H7[sq2])
+	}
+	return uint64(6 * 63 * 62 + 4 * 28 * 62 + 4 * 7 * 28 + (sq0 >> 3) * 7 * 6 +
+		      (sq1 >> 3 - adjust1) * 6 + sq2 >> 3 - adjust2)
+}
+
+// Turn a stored value into a result: WDL values are stored as 0 to 4, and
+// DTZ values may be in moves rather than plies and mapped through a table.
+func (t *tbTable) mapScore(file, value, wdl int) int {
+	if !t.dtz {
+		return value - 2
+	}
+
+	d := t.get(0, file)
+	if d.flags & tbMapped != 0 {
+		i := d.mapIdx[[]int{1, 3, 0, 2, 0}[wdl + 2]]
+		if d.flags & tbWide != 0 {
+			value = int(le16(t.data, t.dtzMap + 2 * (i + value)))
+		} else {
+			value = int(t.data[t.dtzMap + i + value])
+		}
+	}
+
+	if (wdl == WDLWin && d.flags & tbWinPlies == 0) ||
+	   (wdl == WDLLoss && d.flags & tbLossPlies == 0) ||
+	   wdl == WDLCursedWin || wdl == WDLBlessedLoss {
+		value *= 2
+	}
+	return value + 1
+}
+
+// Return the piece on sq as the tables code it: the Piece, plus 8 if it's
+// Black's
+func tbPieceCode(s *State, sq int) byte {
+	code := byte(s.board[sq] & pieceMask)
+	if code != 0 && Color((s.board[sq] & colorMask) >> 3) == Black {
+		code |= 8
+	}
+	return code
+}
+
+// Little- and big-endian numbers in table data. Huffman codes may be read
+// a little past the end of the file, where they're padded with zeros.
+func le16(data []byte, p int) uint16 {
+	return uint16(data[p]) | uint16(data[p + 1]) << 8
+}
+
+func le32(data []byte, p int) uint32 {
+	return uint32(le16(data, p)) | uint32(le16(data, p + 2)) << 16
+}
+
+func be32(data []byte, p int) uint32 {
+	var n uint32
+	for i := 0; i < 4; i++ {
+		n <<= 8
+		if p + i < len(data) {
+			n |= uint32(data[p + i])
+		}
+	}
+	return n
+}
+
+func be64(data []byte, p int) uint64 {
+	return uint64(be32(data, p)) << 32 | uint64(be32(data, p + 4))
+}
@@ -0,0 +1,1247 @@
+// Copyright 2013 Chad Williamson.
+
+// This file is part of Turgenev, a chess program.
+
+// Turgenev is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Turgenev is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License along
+// with Turgenev. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// The tables in testdata/syzygy aren't the real ones (which can't be
+// shipped with the tests) but are written in the same format by this file:
+// with -syzygy.write, TestWriteSyzygy works out every position of the
+// materials in tbLayouts, and of everything their captures and promotions
+// lead to, by retrograde analysis with the engine's own move generator, and
+// then encodes the results. The four-piece materials take over an hour. The
+// other tests only read the tables back, and can be pointed at the real
+// tables with $SYZYGY_TEST_PATH as well.
+var writeSyzygy = flag.Bool("syzygy.write", false, "regenerate the tables in testdata/syzygy")
+
+const syzygyTestdata = "testdata/syzygy"
+
+// Positions whose results are known, from the point of view of the player
+// to move
+var syzygyPositions = []struct {
+	fen string
+	wdl, dtz int
+}{
+	// The longest mates, 10 moves with a queen and 16 with a rook, are
+	// also the longest distances to zeroing: there's nothing else to
+	// capture or push.
+	{"8/8/8/5k2/8/8/1Q6/K7 w - - 0 1", WDLWin, 19},
+	{"8/8/8/8/4k3/8/1Q6/K7 b - - 0 1", WDLLoss, -20},
+	{"8/8/8/8/8/3k4/2R5/1K6 w - - 0 1", WDLWin, 31},
+	{"8/8/8/8/8/8/2Rk4/1K6 b - - 0 1", WDLLoss, -32},
+
+	// Mate and stalemate
+	{"k7/1Q6/1K6/8/8/8/8/8 b - - 0 1", WDLLoss, -1},
+	{"k7/2Q5/1K6/8/8/8/8/8 b - - 0 1", WDLDraw, 0},
+
+	// With the king on the sixth in front of the pawn, White wins with
+	// either player to move, the pawn moving as soon as the king gets
+	// out of its way...
+	{"4k3/8/4K3/4P3/8/8/8/8 w - - 0 1", WDLWin, 3},
+	{"4k3/8/4K3/4P3/8/8/8/8 b - - 0 1", WDLLoss, -4},
+
+	// ...but not once the pawn is on the seventh, or with a rook's pawn.
+	{"4k3/4P3/4K3/8/8/8/8/8 b - - 0 1", WDLDraw, 0},
+	{"k7/8/K7/P7/8/8/8/8 w - - 0 1", WDLDraw, 0},
+
+	// Promoting to a queen stalemates, but a rook wins.
+	{"8/5P1k/8/6K1/8/8/8/8 w - - 0 1", WDLWin, 1},
+
+	// Mates that don't capture, so the DTZ comes from the tables
+	{"k7/8/1K6/8/8/8/7r/4Q3 w - - 0 1", WDLWin, 1},
+	{"k7/8/1K6/8/8/7n/8/4R3 w - - 0 1", WDLWin, 1},
+
+	// Skewered and pinned: any move loses the rook or the knight.
+	{"8/8/8/Q3k2r/8/8/8/K7 b - - 0 1", WDLLoss, -2},
+	{"4k3/8/8/8/4n3/8/8/K3R3 b - - 0 1", WDLLoss, -2},
+
+	// A knight next to its king in the middle of the board holds.
+	{"8/8/8/3kn3/8/8/8/R3K3 w - - 0 1", WDLDraw, 0},
+
+	// The trebuchet: whoever has to move gives up their pawn.
+	{"8/8/8/3Kp3/4Pk2/8/8/8 w - - 0 1", WDLLoss, -2},
+	{"8/8/8/3Kp3/4Pk2/8/8/8 b - - 0 1", WDLLoss, -2},
+
+	// Promoting with check wins, whatever Black does first.
+	{"7k/P7/2K4p/8/8/8/8/8 w - - 0 1", WDLWin, 1},
+	{"7k/P7/2K4p/8/8/8/8/8 b - - 0 1", WDLLoss, -2},
+}
+
+// Return the directories of tables to test: the generated ones and those
+// named by $SYZYGY_TEST_PATH
+func syzygyTestPaths() []string {
+	paths := []string{syzygyTestdata}
+	if path := os.Getenv("SYZYGY_TEST_PATH"); path != "" {
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// Load the tables in path for the rest of the test
+func loadSyzygy(t *testing.T, path string) {
+	if err := SetSyzygyPath(path); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		SetSyzygyPath("")
+	})
+}
+
+func mustFEN(t *testing.T, fen string) *State {
+	s, err := StateFromFEN(fen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// Return s with its squares moved by one of the board's symmetries (as
+// mirrorSquare() numbers them) and, with flip, the colors swapped and the
+// board turned around
+func tbImage(s *State, sym int, flip bool) *State {
+	t := CreateState()
+	for sq := 0; sq < 64; sq++ {
+		sqr := s.board[sq]
+		if sqr & pieceMask == 0 {
+			continue
+		}
+		to := mirrorSquare(sq, sym)
+		if flip {
+			to ^= 56
+			sqr ^= square(White ^ Black) << 3
+		}
+		t.board[to] = sqr
+	}
+
+	t.SetToMove(s.GetToMove())
+	if flip {
+		t.SetToMove(Opponent(s.GetToMove()))
+	}
+	t.halfmoves = s.halfmoves
+	return t
+}
+
+func TestProbeSyzygy(t *testing.T) {
+	for _, path := range syzygyTestPaths() {
+		loadSyzygy(t, path)
+
+		for _, p := range syzygyPositions {
+			s := mustFEN(t, p.fen)
+			for _, s := range []*State{s, tbImage(s, 0, true)} {
+				if wdl, ok := s.ProbeWDL(); !ok || wdl != p.wdl {
+					t.Errorf("%s: %s: WDL %d, %t; want %d", path, s.FEN(),
+						 wdl, ok, p.wdl)
+				}
+				if dtz, ok := s.ProbeDTZ(); !ok || dtz != p.dtz {
+					t.Errorf("%s: %s: DTZ %d, %t; want %d", path, s.FEN(),
+						 dtz, ok, p.dtz)
+				}
+			}
+		}
+	}
+}
+
+// Check the tables against themselves: the result and DTZ of a position
+// must follow from those of its successors.
+func TestSyzygyConsistency(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	for _, path := range syzygyTestPaths() {
+		loadSyzygy(t, path)
+
+		for _, code := range []string{"KQvK", "KRvK", "KPvK", "KQvKR", "KRvKN", "KPvKP"} {
+			for n := 0; n < 100; {
+				s := randomTablebasePosition(r, code)
+				if s == nil {
+					continue
+				}
+				n++
+
+				wdl, dtz := tbOnePly(t, s)
+				if got, ok := s.ProbeWDL(); !ok || got != wdl {
+					t.Errorf("%s: %s: WDL %d, %t; successors give %d",
+						 path, s.FEN(), got, ok, wdl)
+				}
+				if got, ok := s.ProbeDTZ(); !ok || got != dtz {
+					t.Errorf("%s: %s: DTZ %d, %t; successors give %d",
+						 path, s.FEN(), got, ok, dtz)
+				}
+			}
+		}
+	}
+}
+
+// Return a legal position with the given material (stronger side first)
+// and either player to move, with the colors swapped half the time, or nil
+// if the random placement isn't legal
+func randomTablebasePosition(r *rand.Rand, code string) *State {
+	s := CreateState()
+	color := White
+	for _, c := range code {
+		if c == 'v' {
+			color = Black
+			continue
+		}
+		sq := r.Intn(64)
+		piece := PieceFromRune(c)
+		if s.board[sq] != 0 || (piece == Pawn && (sq < 8 || sq >= 56)) {
+			return nil
+		}
+		s.SetPiece(sq >> 3, sq & 7, piece)
+		s.SetColor(sq >> 3, sq & 7, color)
+		s.SetMoved(sq >> 3, sq & 7, piece != Pawn)
+	}
+
+	s.SetToMove(White)
+	if r.Intn(2) == 1 {
+		s.SetToMove(Black)
+	}
+	if s.kingAttacked(Opponent(s.GetToMove())) {
+		return nil
+	}
+	if r.Intn(2) == 1 {
+		s = tbImage(s, 0, true)
+	}
+	return s
+}
+
+// Return the result and DTZ of s according to the tables' values for its
+// successors
+func tbOnePly(t *testing.T, s *State) (wdl, dtz int) {
+	successors := s.LegalSuccessors()
+	if successors.Len() == 0 {
+		if s.InCheck() {
+			return WDLLoss, -1
+		}
+		return WDLDraw, 0
+	}
+
+	wdl = WDLLoss
+	for e := successors.Front(); e != nil; e = e.Next() {
+		if v := -tbProbeWDL(t, e.Value.(*State)); v > wdl {
+			wdl = v
+		}
+	}
+	if wdl == WDLDraw {
+		return wdl, 0
+	}
+
+	// A win takes the quickest way to a winning capture, pawn move or
+	// mate, and a loss puts it off as long as it can.
+	for e := successors.Front(); e != nil; e = e.Next() {
+		c := e.Value.(*State)
+		if -tbProbeWDL(t, c) != wdl {
+			continue
+		}
+
+		plies := 1
+		if !s.zeroing(c) && c.HasLegalMove() {
+			d, ok := c.ProbeDTZ()
+			if !ok {
+				t.Fatalf("%s: no DTZ", c.FEN())
+			}
+			plies += abs(d)
+		}
+
+		if wdl > 0 && (dtz == 0 || plies < dtz) {
+			dtz = plies
+		} else if wdl < 0 && -plies < dtz {
+			dtz = -plies
+		}
+	}
+	return wdl, dtz
+}
+
+// Return the WDL of s, which may have no pieces left besides the kings
+func tbProbeWDL(t *testing.T, s *State) int {
+	if popCount(s.occupiedBy(White) | s.occupiedBy(Black)) == 2 {
+		return WDLDraw
+	}
+	wdl, ok := s.ProbeWDL()
+	if !ok {
+		t.Fatalf("%s: no WDL", s.FEN())
+	}
+	return wdl
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// The best move of a won position, as the tablebases see it, is the one that
+// zeroes soonest: here, an underpromotion.
+func TestTablebaseMove(t *testing.T) {
+	loadSyzygy(t, syzygyTestdata)
+
+	s := mustFEN(t, "8/5P1k/8/6K1/8/8/8/8 w - - 0 1")
+	for _, s := range []*State{s, tbImage(s, 1, true)} {
+		c := TablebaseMove(s)
+		if c == nil {
+			t.Fatalf("%s: no tablebase move", s.FEN())
+		}
+		if move := MoveString(s, c, Coordinate); move != "f7f8r" && move != "c2c1r" {
+			t.Errorf("%s: tablebase move %s", s.FEN(), move)
+		}
+	}
+}
+
+// A win can only be played out if its next capture or pawn move comes
+// before the fifty moves are up.
+func TestTablebaseResultFiftyMoves(t *testing.T) {
+	loadSyzygy(t, syzygyTestdata)
+	defer func(rule bool) {
+		Syzygy50MoveRule = rule
+	}(Syzygy50MoveRule)
+
+	const fen = "8/8/8/8/8/3k4/2R5/1K6 w - - %d 1"
+	s := mustFEN(t, fmt.Sprintf(fen, 0))
+	dtz, ok := s.ProbeDTZ()
+	if !ok || dtz <= 0 {
+		t.Fatalf("%s: DTZ %d, %t", s.FEN(), dtz, ok)
+	}
+
+	for _, test := range []struct {
+		clock int
+		rule bool
+		wdl int
+	}{
+		{0, true, WDLWin},
+		{100 - dtz, true, WDLWin},
+		{101 - dtz, true, WDLCursedWin},
+		{101 - dtz, false, WDLWin},
+	} {
+		Syzygy50MoveRule = test.rule
+		s := mustFEN(t, fmt.Sprintf(fen, test.clock))
+		for _, s := range []*State{s, tbImage(s, 5, true)} {
+			wdl, d, ok := s.TablebaseResult()
+			if !ok || wdl != test.wdl || d != dtz {
+				t.Errorf("%s (rule %t): %d, %d, %t; want %d, %d",
+					 s.FEN(), test.rule, wdl, d, ok, test.wdl, dtz)
+			}
+		}
+	}
+
+	// The clock keeps counting through the moves that follow.
+	Syzygy50MoveRule = true
+	s = mustFEN(t, fmt.Sprintf(fen, 100 - dtz))
+	for _, want := range []int{WDLWin, WDLLoss, WDLWin} {
+		if wdl, _, _ := s.TablebaseResult(); wdl != want {
+			t.Fatalf("%s: %d; want %d", s.FEN(), wdl, want)
+		}
+		s = TablebaseMove(s)
+	}
+	s = mustFEN(t, fmt.Sprintf(fen, 101 - dtz))
+	for _, want := range []int{WDLCursedWin, WDLBlessedLoss, WDLCursedWin} {
+		if wdl, _, _ := s.TablebaseResult(); wdl != want {
+			t.Fatalf("%s: %d; want %d", s.FEN(), wdl, want)
+		}
+		s = TablebaseMove(s)
+	}
+	if v := TablebaseValue(WDLCursedWin, 0); IsMateScore(v) || v > MaterialValue(Pawn) {
+		t.Errorf("cursed win scores %d", v)
+	}
+}
+
+// TestWriteSyzygy() regenerates the tables in testdata/syzygy.
+func TestWriteSyzygy(t *testing.T) {
+	if !*writeSyzygy {
+		t.Skip("run with -syzygy.write to regenerate the tables")
+	}
+
+	models := make(map[string]*tbModel)
+	var codes []string
+	for _, l := range tbLayouts {
+		codes = append(codes, l.code)
+	}
+	if err := newTBModels(codes, models); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(syzygyTestdata, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range tbLayouts {
+		for _, dtz := range []bool{false, true} {
+			if dtz && l.dtzSTM == nil {
+				continue
+			}
+			if err := writeTBFile(syzygyTestdata, l, models[l.code], dtz); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Read the positions back: what's stored, where it's looked up, and
+	// what a probe makes of it, for every position of the smaller tables
+	// and some of the rest.
+	loadSyzygy(t, syzygyTestdata)
+	for _, l := range tbLayouts {
+		m := models[l.code]
+		for idx, valid := range m.valid {
+			if !valid {
+				continue
+			}
+			s := m.table.state(idx)
+			wdl, dtz := int(m.wdl[idx]), int(m.dtz[idx])
+			got, result := s.probeTable(false, WDLDraw)
+			if !m.captureWins[idx] && (result != tbOK || got != wdl) {
+				t.Fatalf("%s: stored WDL %d (%d); want %d", s.FEN(), got, result, wdl)
+			}
+			if wdl != WDLDraw && !m.zeroingWins[idx] && l.dtzSTM != nil {
+				got, result := s.probeTable(true, wdl)
+				if result != tbChangeSTM && (result != tbOK || got != abs(dtz)) {
+					t.Fatalf("%s: stored DTZ %d (%d); want %d", s.FEN(), got, result, abs(dtz))
+				}
+			}
+			if l.dtzSTM == nil || len(m.table.pieces) > 3 && idx % 64 != 0 {
+				continue
+			}
+
+			if got, ok := s.ProbeWDL(); !ok || got != wdl {
+				t.Fatalf("%s: WDL %d, %t; want %d", s.FEN(), got, ok, wdl)
+			}
+			if got, ok := s.ProbeDTZ(); !ok || got != dtz {
+				t.Fatalf("%s: DTZ %d, %t; want %d", s.FEN(), got, ok, dtz)
+			}
+		}
+	}
+}
+
+// A tbModel holds the result and DTZ of every position of a material (for
+// the player to move), worked out by retrograde analysis and indexed as in
+// an EndgameTable. It also notes the positions where the WDL or DTZ file
+// may store anything, since probes don't look them up: those where the
+// player to move wins by a capture, or for DTZ by any zeroing move.
+type tbModel struct {
+	table *EndgameTable
+	valid []bool
+	wdl []int8
+	dtz []int16
+	captureWins, zeroingWins []bool
+}
+
+// A move in a tbModel: the index of the position it reaches, with
+// tbZeroing set for a pawn move, or for a move to other material tbExit
+// and the result plus 2 (with tbCapture if it captures)
+type tbMove int32
+
+const (
+	tbZeroing tbMove = 1 << 30
+	tbCapture tbMove = 1 << 29
+	tbExit tbMove = 1 << 28
+)
+
+// Return the index the move reaches, or -1 if that has other material
+func (m tbMove) to() int {
+	if m & tbExit != 0 {
+		return -1
+	}
+	return int(m &^ tbZeroing)
+}
+
+func (m tbMove) zeroing() bool {
+	return m & tbZeroing != 0
+}
+
+// Work out the models of the given materials, and first of those their
+// captures and promotions lead to, adding them to models.
+func newTBModels(codes []string, models map[string]*tbModel) error {
+	for _, code := range codes {
+		code = canonicalCode(code)
+		if models[code] != nil {
+			continue
+		}
+		if err := newTBModels(EndgameDependencies(code), models); err != nil {
+			return err
+		}
+		m, err := newTBModel(code, models)
+		if err != nil {
+			return err
+		}
+		models[code] = m
+	}
+	return nil
+}
+
+// Work out the model of the given material. The models its captures and
+// promotions lead to must already be in models.
+func newTBModel(code string, models map[string]*tbModel) (*tbModel, error) {
+	table, err := NewEndgameTable(code)
+	if err != nil {
+		return nil, err
+	}
+	n := len(table.Values)
+	m := &tbModel{table: table, valid: make([]bool, n),
+		      wdl: make([]int8, n), dtz: make([]int16, n),
+		      captureWins: make([]bool, n), zeroingWins: make([]bool, n)}
+
+	// The moves of position idx are moves[first[idx]:first[idx + 1]].
+	first, moves := make([]int, n + 1), []tbMove(nil)
+	known, mated := make([]bool, n), make([]bool, n)
+	for idx := range m.valid {
+		first[idx] = len(moves)
+		s := table.state(idx)
+		if s == nil {
+			continue
+		}
+		m.valid[idx] = true
+
+		successors := s.endgameSuccessors()
+		for _, c := range successors {
+			var move tbMove
+			switch c.EndgameCode() {
+			case table.Code:
+				move = tbMove(table.StateIndex(c))
+				if s.zeroing(c) {
+					move |= tbZeroing
+				}
+			case "KvK":
+				move = tbExit | tbZeroing | tbMove(WDLDraw + 2)
+			default:
+				exit := models[c.EndgameCode()]
+				if exit == nil {
+					return nil, fmt.Errorf("%s: no model for %s", code, c.EndgameCode())
+				}
+				wdl := int(exit.wdl[exit.table.StateIndex(c)])
+				move = tbExit | tbZeroing | tbMove(wdl + 2)
+			}
+			if s.capture(c) {
+				move |= tbCapture
+			}
+			moves = append(moves, move)
+		}
+
+		if len(successors) == 0 {
+			known[idx] = true
+			if s.kingAttacked(s.GetToMove()) {
+				m.wdl[idx], m.dtz[idx], mated[idx] = WDLLoss, -1, true
+			}
+		}
+	}
+	first[n] = len(moves)
+
+	// Return the result of a move, which for one to a position of the
+	// same material is only known once that position is
+	result := func(move tbMove) (int, bool) {
+		if to := move.to(); to >= 0 {
+			return int(m.wdl[to]), known[to]
+		}
+		return int(move & 7) - 2, true
+	}
+
+	// A position is won once one of its moves reaches a lost one, and
+	// lost once all of them reach won ones. The rest are drawn.
+	for changed := true; changed; {
+		changed = false
+		for idx, valid := range m.valid {
+			if !valid || known[idx] {
+				continue
+			}
+
+			win, loss := false, true
+			for _, move := range moves[first[idx]:first[idx + 1]] {
+				wdl, ok := result(move)
+				if !ok {
+					loss = false
+					continue
+				}
+				win = win || wdl == WDLLoss
+				loss = loss && wdl == WDLWin
+			}
+
+			if win || loss {
+				m.wdl[idx], known[idx], changed = WDLLoss, true, true
+				if win {
+					m.wdl[idx] = WDLWin
+				}
+			}
+		}
+	}
+
+	for idx, valid := range m.valid {
+		if !valid || m.wdl[idx] != WDLWin {
+			continue
+		}
+		for _, move := range moves[first[idx]:first[idx + 1]] {
+			if wdl, _ := result(move); wdl == WDLLoss && move.zeroing() {
+				m.zeroingWins[idx] = true
+				m.captureWins[idx] = m.captureWins[idx] || move & tbCapture != 0
+			}
+		}
+	}
+
+	// DTZs go up a ply at a time: a win reaches the next capture, pawn
+	// move or mate as soon as it can, and a loss puts it off as long as
+	// it can.
+	for plies, quiet := 1, 0; quiet < 2; plies++ {
+		quiet++
+		for idx, valid := range m.valid {
+			if !valid || m.wdl[idx] != WDLWin || m.dtz[idx] != 0 {
+				continue
+			}
+			for _, move := range moves[first[idx]:first[idx + 1]] {
+				if wdl, _ := result(move); wdl != WDLLoss {
+					continue
+				}
+
+				to := move.to()
+				if move.zeroing() || mated[to] {
+					if plies == 1 {
+						m.dtz[idx], quiet = 1, 0
+						break
+					}
+				} else if plies > 1 && int(m.dtz[to]) == 1 - plies {
+					m.dtz[idx], quiet = int16(plies), 0
+					break
+				}
+			}
+		}
+
+		for idx, valid := range m.valid {
+			if !valid || m.wdl[idx] != WDLLoss || m.dtz[idx] != 0 {
+				continue
+			}
+			longest := 0
+			for _, move := range moves[first[idx]:first[idx + 1]] {
+				plies := 1
+				if to := move.to(); !move.zeroing() {
+					if m.dtz[to] == 0 {
+						longest = 0
+						break
+					}
+					plies += int(m.dtz[to])
+				}
+				if plies > longest {
+					longest = plies
+				}
+			}
+			if longest > 0 {
+				m.dtz[idx], quiet = int16(-longest), 0
+			}
+		}
+	}
+
+	for idx, valid := range m.valid {
+		switch {
+		case !valid:
+		case m.wdl[idx] != WDLDraw && m.dtz[idx] == 0:
+			return nil, fmt.Errorf("%s: no DTZ for %s", code, table.state(idx).FEN())
+		case abs(int(m.dtz[idx])) > 100:
+			return nil, fmt.Errorf("%s: DTZ %d for %s", code, m.dtz[idx],
+					       table.state(idx).FEN())
+		}
+	}
+
+	return m, nil
+}
+
+// A tbLayout says how the files of a table are laid out: the order of the
+// pieces and of the groups they're indexed in for each player to move (for
+// the DTZ file, only that of the first), the player to move the DTZ file
+// keeps for each file of the leading pawn, and whether its values go
+// through maps. A group's order is given for the leading pieces or pawns
+// and, if both sides have pawns, for the others (0xF if not). Tables
+// without dtzSTM have no DTZ file: those KPvKP promotes to are only needed
+// for their WDL. The layouts differ so as to cover the ways of reading
+// them.
+type tbLayout struct {
+	code string
+	pieces [2]string
+	order [2][2]int
+	dtzSTM []int
+	mapped bool
+}
+
+var tbLayouts = []tbLayout{
+	{"KQvK", [2]string{"KQk", "kKQ"}, [2][2]int{{0, 0xF}, {0, 0xF}}, []int{0}, false},
+	{"KRvK", [2]string{"RKk", "KkR"}, [2][2]int{{0, 0xF}, {0, 0xF}}, []int{1}, false},
+	{"KBvK", [2]string{"KBk", "KBk"}, [2][2]int{{0, 0xF}, {0, 0xF}}, []int{0}, false},
+	{"KNvK", [2]string{"KNk", "KNk"}, [2][2]int{{0, 0xF}, {0, 0xF}}, []int{0}, false},
+	{"KPvK", [2]string{"PKk", "PkK"}, [2][2]int{{0, 0xF}, {2, 0xF}}, []int{0, 1, 0, 1}, true},
+	{"KQvKR", [2]string{"KQkr", "QrKk"}, [2][2]int{{0, 0xF}, {1, 0xF}}, []int{0}, false},
+	{"KRvKN", [2]string{"KkRn", "RnkK"}, [2][2]int{{1, 0xF}, {0, 0xF}}, []int{1}, true},
+	{"KPvKP", [2]string{"PpkK", "PpkK"}, [2][2]int{{1, 3}, {1, 3}}, []int{0, 0, 0, 0}, false},
+	{"KQvKP", [2]string{"pKQk", "pkKQ"}, [2][2]int{{0, 0xF}, {2, 0xF}}, nil, false},
+	{"KRvKP", [2]string{"pKRk", "pRkK"}, [2][2]int{{2, 0xF}, {0, 0xF}}, nil, false},
+	{"KBvKP", [2]string{"pKBk", "pkKB"}, [2][2]int{{0, 0xF}, {1, 0xF}}, nil, false},
+	{"KNvKP", [2]string{"pKNk", "pkKN"}, [2][2]int{{0, 0xF}, {1, 0xF}}, nil, false},
+}
+
+// Encode the model's values in a WDL or DTZ file in dir.
+func writeTBFile(dir string, l tbLayout, m *tbModel, dtz bool) error {
+	e := newTablebaseEntry(l.code)
+	t := &tbTable{dtz: dtz, sides: 2}
+	ext := ".rtbw"
+	if dtz || e.key == e.key2 {
+		t.sides = 1
+	}
+	if dtz {
+		ext = ".rtbz"
+	}
+	files := 1
+	if e.hasPawns {
+		files = 4
+	}
+
+	// Set up the tables' indexing as the header will describe it.
+	var values [2][4][]int
+	var results [2][4][]int
+	for f := 0; f < files; f++ {
+		for i := 0; i < t.sides; i++ {
+			d := &t.pairs[i][f]
+			for k, r := range tbLayoutPieces(l, i) {
+				d.pieces[k] = r
+			}
+			d.setGroups(e, l.order[i], f)
+			if dtz {
+				d.flags = byte(l.dtzSTM[f])
+			}
+
+			size := tbPairsSize(d)
+			values[i][f], results[i][f] = make([]int, size), make([]int, size)
+			for j := range values[i][f] {
+				values[i][f][j] = -1
+			}
+		}
+	}
+
+	// Store each position whose value is looked up under all of its
+	// mirror images, checking that positions sharing an index agree.
+	symmetries := 8
+	if e.hasPawns {
+		symmetries = 2
+	}
+	for idx, valid := range m.valid {
+		if !valid || (dtz && (m.wdl[idx] == WDLDraw || m.zeroingWins[idx])) ||
+		   (!dtz && m.captureWins[idx]) {
+			continue
+		}
+		s := m.table.state(idx)
+		wdl := int(m.wdl[idx])
+		value := wdl + 2
+		if dtz {
+			value = abs(int(m.dtz[idx]))
+		}
+
+		for sym := 0; sym < symmetries; sym++ {
+			for _, flip := range []bool{false, true} {
+				stm, file, i, ok := e.index(tbImage(s, sym, flip), t)
+				if !ok {
+					continue
+				}
+				stm %= t.sides
+				if v := values[stm][file][i]; v >= 0 && v != value ||
+				   v >= 0 && results[stm][file][i] != wdl {
+					return fmt.Errorf("%s: %s shares index %d with a different value",
+							  l.code, s.FEN(), i)
+				}
+				values[stm][file][i], results[stm][file][i] = value, wdl
+			}
+		}
+	}
+
+	var pairs [2][4]*tbEncoded
+	var maps [4][4][]int
+	for f := 0; f < files; f++ {
+		for i := 0; i < t.sides; i++ {
+			vals := values[i][f]
+			if dtz {
+				flags := tbDTZFlags(vals, results[i][f])
+				if l.mapped {
+					flags |= tbMapped
+					maps[f] = tbDTZMaps(vals, results[i][f], flags)
+				}
+				for j, v := range vals {
+					if v >= 0 {
+						vals[j] = tbStoredDTZ(v, results[i][f][j], flags, maps[f])
+					}
+				}
+				t.pairs[i][f].flags |= flags
+			}
+
+			// Positions that can't come up or aren't looked up take the
+			// value before them, which costs the least to encode.
+			last := 0
+			for _, v := range vals {
+				if v >= 0 {
+					last = v
+					break
+				}
+			}
+			for j, v := range vals {
+				if v < 0 {
+					vals[j] = last
+				}
+				last = vals[j]
+			}
+
+			enc, err := tbEncode(vals, t.pairs[i][f].flags)
+			if err != nil {
+				return fmt.Errorf("%s%s: %v", l.code, ext, err)
+			}
+			pairs[i][f] = enc
+		}
+	}
+
+	data := tbDTZMagic
+	if !dtz {
+		data = tbWDLMagic
+	}
+	data = append([]byte(nil), data...)
+	data = append(data, byte(boolInt(e.key != e.key2) | 2 * boolInt(e.hasPawns)))
+	for f := 0; f < files; f++ {
+		data = append(data, byte(l.order[0][0] | l.order[1][0] << 4))
+		if e.hasPawns && e.pawnCount[1] > 0 {
+			data = append(data, byte(l.order[0][1] | l.order[1][1] << 4))
+		}
+		side0, side1 := tbLayoutPieces(l, 0), tbLayoutPieces(l, 1)
+		for k := range side0 {
+			data = append(data, side0[k] | side1[k] << 4)
+		}
+	}
+	data = tbPad(data, 2)
+
+	for f := 0; f < files; f++ {
+		for i := 0; i < t.sides; i++ {
+			data = append(data, pairs[i][f].header()...)
+		}
+	}
+	if dtz {
+		for f := 0; f < files; f++ {
+			if l.mapped {
+				for _, values := range maps[f] {
+					data = append(data, byte(len(values)))
+					for _, v := range values {
+						data = append(data, byte(v))
+					}
+				}
+			}
+		}
+		data = tbPad(data, 2)
+	}
+	for f := 0; f < files; f++ {
+		for i := 0; i < t.sides; i++ {
+			for _, entry := range pairs[i][f].sparseIndex {
+				data = appendLE(data, uint64(entry[0]), 4)
+				data = appendLE(data, uint64(entry[1]), 2)
+			}
+		}
+	}
+	for f := 0; f < files; f++ {
+		for i := 0; i < t.sides; i++ {
+			for _, n := range pairs[i][f].blockLengths {
+				data = appendLE(data, uint64(n - 1), 2)
+			}
+		}
+	}
+	for f := 0; f < files; f++ {
+		for i := 0; i < t.sides; i++ {
+			data = tbPad(data, 64)
+			for _, block := range pairs[i][f].blocks {
+				data = append(data, block...)
+			}
+		}
+	}
+	data = tbPad(data, 64)
+
+	return ioutil.WriteFile(filepath.Join(dir, l.code + ext), data, 0644)
+}
+
+// Return the piece codes of a layout for the given player to move: white
+// pieces are written in capitals, so "Kkr" would be White's king, Black's
+// king and Black's rook.
+func tbLayoutPieces(l tbLayout, side int) []byte {
+	var codes []byte
+	for _, r := range l.pieces[side] {
+		code := byte(PieceFromRune(r))
+		if strings.ToLower(string(r)) == string(r) {
+			code |= 8
+		}
+		codes = append(codes, code)
+	}
+	return codes
+}
+
+// Return the number of values in a subtable
+func tbPairsSize(d *tbPairs) int {
+	n := 0
+	for d.groupLen[n] != 0 {
+		n++
+	}
+	return int(d.groupIdx[n])
+}
+
+// Return the flags a DTZ subtable needs for its values to be stored
+// exactly: in plies unless they're all odd.
+func tbDTZFlags(values, results []int) byte {
+	var flags byte
+	for j, v := range values {
+		if v > 0 && v % 2 == 0 {
+			if results[j] > 0 {
+				flags |= tbWinPlies
+			} else {
+				flags |= tbLossPlies
+			}
+		}
+	}
+	return flags
+}
+
+// Return the maps of a DTZ subtable's stored values for each result, in
+// the order mapScore() looks them up: wins, losses, cursed wins and
+// blessed losses.
+func tbDTZMaps(values, results []int, flags byte) [4][]int {
+	var maps [4][]int
+	seen := make(map[[2]int]bool)
+	for j, v := range values {
+		if v < 0 || seen[[2]int{results[j], v}] {
+			continue
+		}
+		seen[[2]int{results[j], v}] = true
+		i := []int{1, 3, 0, 2, 0}[results[j] + 2]
+		maps[i] = append(maps[i], tbStoredDTZ(v, results[j], flags &^ tbMapped, maps))
+	}
+	for i := range maps {
+		sort.Ints(maps[i])
+	}
+	return maps
+}
+
+// Return the value stored for a DTZ of the given size and result
+func tbStoredDTZ(dtz, wdl int, flags byte, maps [4][]int) int {
+	v := dtz - 1
+	if wdl == WDLWin && flags & tbWinPlies == 0 ||
+	   wdl == WDLLoss && flags & tbLossPlies == 0 {
+		v /= 2
+	}
+	if flags & tbMapped != 0 {
+		m := maps[[]int{1, 3, 0, 2, 0}[wdl + 2]]
+		v = sort.SearchInts(m, v)
+	}
+	return v
+}
+
+// Return data padded with zeros to a multiple of n bytes
+func tbPad(data []byte, n int) []byte {
+	for len(data) % n != 0 {
+		data = append(data, 0)
+	}
+	return data
+}
+
+// Append the low bytes of v to data, least significant first
+func appendLE(data []byte, v uint64, bytes int) []byte {
+	for i := 0; i < bytes; i++ {
+		data = append(data, byte(v >> uint(8 * i)))
+	}
+	return data
+}
+
+// A tbEncoded is one subtable's values, paired up into symbols and Huffman
+// coded in blocks.
+type tbEncoded struct {
+	flags byte
+	single int
+
+	minLen, maxLen int
+	lowestSym []int
+	btree [][2]int
+	blockLengths []int
+	sparseIndex [][2]int
+	blocks [][]byte
+}
+
+const (
+	tbBlockLog = 6
+	tbSpanLog = 10
+
+	// Symbols are numbered in 12 bits, 0xFFF marking a value. A block has
+	// at most one symbol to a bit, so they can't stand for too many values
+	// if a block's count is to fit in 16 bits.
+	tbMaxSymbols = 0xFFF
+	tbMaxSymLen = 1 << (16 - 3 - tbBlockLog)
+
+	// How often a pair of symbols has to come up to be made a symbol
+	tbMinPairs = 16
+)
+
+// Pair up and Huffman code the values in blocks, with a sparse index into
+// them.
+func tbEncode(values []int, flags byte) (*tbEncoded, error) {
+	enc := &tbEncoded{flags: flags}
+
+	distinct := make(map[int]bool)
+	for _, v := range values {
+		distinct[v] = true
+	}
+	if len(distinct) == 1 {
+		enc.flags |= tbSingleValue
+		enc.single = values[0]
+		return enc, nil
+	}
+
+	seq, btree, symLens := tbPairUp(values)
+	counts := make(map[int]int)
+	for _, sym := range seq {
+		counts[sym]++
+	}
+	// A code needs two symbols, even if one of them is never used.
+	for sym := 0; len(counts) < 2; sym++ {
+		if _, ok := counts[sym]; !ok {
+			counts[sym] = 0
+		}
+	}
+
+	lengths := tbCodeLengths(counts)
+	enc.minLen, enc.maxLen = 64, 0
+	for _, n := range lengths {
+		if n < enc.minLen {
+			enc.minLen = n
+		}
+		if n > enc.maxLen {
+			enc.maxLen = n
+		}
+	}
+	if enc.maxLen > 32 {
+		return nil, fmt.Errorf("code length %d is too long", enc.maxLen)
+	}
+
+	// Symbols are numbered from the longest codes to the shortest, and
+	// codes of the same length are consecutive, the longer ones lower.
+	// Symbols that only make up others come last.
+	byLength := make([][]int, enc.maxLen + 1)
+	for sym, n := range lengths {
+		byLength[n] = append(byLength[n], sym)
+	}
+	code, number := make(map[int]uint64), make([]int, len(btree))
+	for sym := range number {
+		number[sym] = -1
+	}
+	var order []int
+	base := uint64(0)
+	enc.lowestSym = make([]int, enc.maxLen - enc.minLen + 1)
+	for n := enc.maxLen; n >= enc.minLen; n-- {
+		if n < enc.maxLen {
+			longer := base + uint64(len(byLength[n + 1]))
+			if longer % 2 != 0 {
+				return nil, fmt.Errorf("incomplete code")
+			}
+			base = longer / 2
+		}
+		sort.Ints(byLength[n])
+		enc.lowestSym[n - enc.minLen] = len(order)
+		for j, sym := range byLength[n] {
+			code[sym] = base + uint64(j)
+			number[sym] = len(order)
+			order = append(order, sym)
+		}
+	}
+	if base + uint64(len(byLength[enc.minLen])) != 1 << uint(enc.minLen) {
+		return nil, fmt.Errorf("incomplete code")
+	}
+	for sym := range btree {
+		if number[sym] < 0 {
+			number[sym] = len(order)
+			order = append(order, sym)
+		}
+	}
+	for _, sym := range order {
+		node := btree[sym]
+		if node[1] != 0xFFF {
+			node = [2]int{number[node[0]], number[node[1]]}
+		}
+		enc.btree = append(enc.btree, node)
+	}
+
+	// Fill blocks with as many whole codes as they hold.
+	blockBits := 8 << tbBlockLog
+	var block []byte
+	bits, count, pos := 0, 0, 0
+	var starts []int
+	for _, sym := range seq {
+		n := lengths[sym]
+		if bits + n > blockBits {
+			enc.blocks = append(enc.blocks, tbPad(block, 1 << tbBlockLog))
+			enc.blockLengths = append(enc.blockLengths, count)
+			block, bits, count = nil, 0, 0
+		}
+		if count == 0 {
+			starts = append(starts, pos)
+		}
+		for b := n - 1; b >= 0; b-- {
+			if bits % 8 == 0 {
+				block = append(block, 0)
+			}
+			if code[sym] >> uint(b) & 1 != 0 {
+				block[bits / 8] |= 0x80 >> uint(bits % 8)
+			}
+			bits++
+		}
+		count += symLens[sym]
+		pos += symLens[sym]
+	}
+	enc.blocks = append(enc.blocks, tbPad(block, 1 << tbBlockLog))
+	enc.blockLengths = append(enc.blockLengths, count)
+
+	// Each entry of the sparse index gives the block holding the middle
+	// value of its span and that value's offset in the block.
+	span := 1 << tbSpanLog
+	for k := 0; k * span < len(values); k++ {
+		idx := k * span + span / 2
+		b := sort.SearchInts(starts, idx + 1) - 1
+		offset := idx - starts[b]
+		if offset >= 1 << 16 {
+			return nil, fmt.Errorf("sparse index offset %d is too large", offset)
+		}
+		enc.sparseIndex = append(enc.sparseIndex, [2]int{b, offset})
+	}
+
+	return enc, nil
+}
+
+// Turn the values into symbols, each of which stands for a value or for two
+// symbols in a row: every round, the commonest pairs of symbols become new
+// symbols, until no pair comes up often enough. Returns the sequence of
+// symbols, each symbol's value and 0xFFF or its two halves, and the number
+// of values each stands for.
+func tbPairUp(values []int) (seq []int, btree [][2]int, symLens []int) {
+	leaves := make(map[int]int)
+	for _, v := range values {
+		if _, ok := leaves[v]; !ok {
+			leaves[v] = len(btree)
+			btree = append(btree, [2]int{v, 0xFFF})
+			symLens = append(symLens, 1)
+		}
+		seq = append(seq, leaves[v])
+	}
+
+	for len(btree) < tbMaxSymbols {
+		counts := make(map[[2]int]int)
+		for i := 0; i + 1 < len(seq); i++ {
+			counts[[2]int{seq[i], seq[i + 1]}]++
+		}
+
+		var common [][2]int
+		for pair, n := range counts {
+			if n >= tbMinPairs && symLens[pair[0]] + symLens[pair[1]] <= tbMaxSymLen {
+				common = append(common, pair)
+			}
+		}
+		if len(common) == 0 {
+			break
+		}
+		sort.Slice(common, func(i, j int) bool {
+			a, b := common[i], common[j]
+			if counts[a] != counts[b] {
+				return counts[a] > counts[b]
+			}
+			return a[0] < b[0] || a[0] == b[0] && a[1] < b[1]
+		})
+		if n := tbMaxSymbols - len(btree); len(common) > n {
+			common = common[:n]
+		}
+		if len(common) > 64 {
+			common = common[:64]
+		}
+
+		paired := make(map[[2]int]int)
+		for _, pair := range common {
+			paired[pair] = len(btree)
+			btree = append(btree, pair)
+			symLens = append(symLens, symLens[pair[0]] + symLens[pair[1]])
+		}
+		next := seq[:0]
+		for i := 0; i < len(seq); i++ {
+			if i + 1 < len(seq) {
+				if sym, ok := paired[[2]int{seq[i], seq[i + 1]}]; ok {
+					next = append(next, sym)
+					i++
+					continue
+				}
+			}
+			next = append(next, seq[i])
+		}
+		seq = next
+	}
+
+	return seq, btree, symLens
+}
+
+// Return the length of each symbol's Huffman code
+func tbCodeLengths(counts map[int]int) map[int]int {
+	type node struct {
+		count int
+		values []int
+	}
+	var nodes []node
+	for v, n := range counts {
+		nodes = append(nodes, node{n, []int{v}})
+	}
+
+	lengths := make(map[int]int)
+	for len(nodes) > 1 {
+		sort.Slice(nodes, func(i, j int) bool {
+			if nodes[i].count != nodes[j].count {
+				return nodes[i].count < nodes[j].count
+			}
+			return nodes[i].values[0] < nodes[j].values[0]
+		})
+		merged := node{nodes[0].count + nodes[1].count,
+			       append(append([]int(nil), nodes[0].values...), nodes[1].values...)}
+		for _, v := range merged.values {
+			lengths[v]++
+		}
+		nodes = append([]node{merged}, nodes[2:]...)
+	}
+	return lengths
+}
+
+// Return the subtable's part of the header, as setSizes() reads it
+func (enc *tbEncoded) header() []byte {
+	data := []byte{enc.flags}
+	if enc.flags & tbSingleValue != 0 {
+		return append(data, byte(enc.single))
+	}
+
+	data = append(data, tbBlockLog, tbSpanLog, 0)
+	data = appendLE(data, uint64(len(enc.blocks)), 4)
+	data = append(data, byte(enc.maxLen), byte(enc.minLen))
+	for _, sym := range enc.lowestSym {
+		data = appendLE(data, uint64(sym), 2)
+	}
+
+	data = appendLE(data, uint64(len(enc.btree)), 2)
+	for _, node := range enc.btree {
+		data = append(data, byte(node[0]), byte(node[0] >> 8 & 0xF | node[1] << 4),
+			      byte(node[1] >> 4))
+	}
+	return tbPad(data, 2)
+}
@@ -0,0 +1,285 @@
+// Copyright 2013 Chad Williamson.
+
+// This file is part of Turgenev, a chess program.
+
+// Turgenev is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Turgenev is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License along
+// with Turgenev. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A LabeledPosition is a training position for the tuner, along with the
+// result of the game it came from: 1 if White won, 0.5 for a draw and 0 if
+// Black won.
+type LabeledPosition struct {
+	State *State
+	Result float64
+}
+
+// Tune() is the "tune" subcommand, a Texel-style tuner. It adjusts the
+// evaluation weights to minimize the squared difference between the game
+// results and a sigmoid of the quiescence search score of each position,
+// by local search: each weight is nudged up or down by one as long as that
+// reduces the error. The weights are written out after every pass.
+func Tune(args []string) int {
+	flags := flag.NewFlagSet("tune", flag.ExitOnError)
+	positions := flags.String("positions", "", "file of FENs labeled with game results")
+	out := flags.String("out", "weights.json", "file to write the tuned weights to")
+	threads := flags.Int("threads", Threads, "number of goroutines evaluating positions")
+	passes := flags.Int("passes", 100, "maximum number of passes over the weights")
+	k := flags.Float64("k", 0, "sigmoid scaling constant (0 to fit it to the data)")
+	flags.Parse(args)
+
+	if *positions == "" {
+		fmt.Fprintln(os.Stderr, "tune: no -positions file given")
+		return 2
+	}
+
+	data, err := ReadLabeledPositions(*positions)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "tune:", err)
+		return 1
+	}
+	fmt.Printf("Read %d positions from %s\n", len(data), *positions)
+
+	if *k == 0 {
+		*k = FitScalingConstant(data, *threads)
+	}
+	best := TuningError(data, *k, *threads)
+	fmt.Printf("K = %.3f, initial error = %.6f\n", *k, best)
+
+	weights := TunableWeights()
+	for pass := 1; pass <= *passes; pass++ {
+		improved := 0
+
+		for _, w := range weights {
+			for _, delta := range []int{1, -2} {
+				*w.Value += delta
+				ClearPawnTable()
+				if e := TuningError(data, *k, *threads); e < best {
+					best = e
+					improved++
+					break
+				}
+				if delta < 0 {
+					*w.Value += 1
+					ClearPawnTable()
+				}
+			}
+		}
+
+		if err := SaveParams(*out); err != nil {
+			fmt.Fprintln(os.Stderr, "tune:", err)
+			return 1
+		}
+		fmt.Printf("Pass %d: error = %.6f (%d weights changed), saved to %s\n",
+			   pass, best, improved, *out)
+
+		if improved == 0 {
+			break
+		}
+	}
+
+	return 0
+}
+
+// TunableWeights() returns the weights that the tuner adjusts. The value of
+// a pawn is held fixed as the unit of evaluation, and weights that can
+// never affect the evaluation (such as those for empty squares, kings'
+// material or pawns on the back ranks) are left out.
+func TunableWeights() []Weight {
+	var weights []Weight
+
+	for _, w := range Params.Weights() {
+		if !fixedWeight(w.Name) {
+			weights = append(weights, w)
+		}
+	}
+
+	return weights
+}
+
+// Return true iff the tuner should leave the named weight alone
+func fixedWeight(name string) bool {
+	switch name {
+	case "PieceValue0", "PieceValue1", "PieceValue6":
+		return true
+	}
+	if strings.HasPrefix(name, "TypicalMobility") {
+		return true
+	}
+
+	for _, table := range []string{"MgPieceSquare", "EgPieceSquare"} {
+		if strings.HasPrefix(name, table) {
+			piece := Piece(name[len(table)] - '0')
+			index, _ := strconv.Atoi(name[len(table) + 1:])
+			return piece == Empty ||
+			       (piece == Pawn && (index < 8 || index >= 56))
+		}
+	}
+
+	return false
+}
+
+// TuningError() returns the mean squared error between the results of the
+// positions and the results predicted from their quiescence search scores.
+// The positions are split between the given number of goroutines.
+func TuningError(data []LabeledPosition, k float64, threads int) float64 {
+	sums := make([]float64, threads)
+	var wg sync.WaitGroup
+
+	for t := 0; t < threads; t++ {
+		wg.Add(1)
+		go func(t int) {
+			defer wg.Done()
+			for i := t; i < len(data); i += threads {
+				d := data[i].Result - Sigmoid(WhiteQuiesce(data[i].State), k)
+				sums[t] += d * d
+			}
+		}(t)
+	}
+	wg.Wait()
+
+	total := 0.0
+	for _, sum := range sums {
+		total += sum
+	}
+	return total / float64(len(data))
+}
+
+// Sigmoid() maps a score in centipawns to an expected result for White.
+func Sigmoid(score, k float64) float64 {
+	return 1 / (1 + math.Pow(10, -k * score / 400))
+}
+
+// WhiteQuiesce() returns the quiescence search score of s in centipawns,
+// from White's point of view.
+func WhiteQuiesce(s *State) float64 {
+	score := s.Quiesce(NewSearch(DefaultEvaluator), NegInfinity, PosInfinity)
+	if s.GetToMove() == Black {
+		score = -score
+	}
+	return float64(Centipawns(score))
+}
+
+// FitScalingConstant() finds the sigmoid scaling constant K that best fits
+// the data with the current weights, by narrowing in on it a digit at a
+// time. The scores are computed only once.
+func FitScalingConstant(data []LabeledPosition, threads int) float64 {
+	scores := make([]float64, len(data))
+	var wg sync.WaitGroup
+
+	for t := 0; t < threads; t++ {
+		wg.Add(1)
+		go func(t int) {
+			defer wg.Done()
+			for i := t; i < len(data); i += threads {
+				scores[i] = WhiteQuiesce(data[i].State)
+			}
+		}(t)
+	}
+	wg.Wait()
+
+	errorAt := func(k float64) float64 {
+		sum := 0.0
+		for i, score := range scores {
+			d := data[i].Result - Sigmoid(score, k)
+			sum += d * d
+		}
+		return sum
+	}
+
+	best, step := 1.0, 1.0
+	for digit := 0; digit < 4; digit++ {
+		start := math.Max(best - step, step / 10)
+		for k := start; k <= best + step; k += step / 10 {
+			if errorAt(k) < errorAt(best) {
+				best = k
+			}
+		}
+		step /= 10
+	}
+
+	return best
+}
+
+// ReadLabeledPositions() reads a file with a position on each line: a FEN
+// followed somewhere by the game's result, written as 1-0, 0-1 or 1/2-1/2
+// (possibly quoted, as in an EPD "c9" field) or as [1.0], [0.5] or [0.0].
+// Blank lines and lines starting with '#' are skipped.
+func ReadLabeledPositions(path string) ([]LabeledPosition, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var data []LabeledPosition
+	scanner, n := bufio.NewScanner(f), 0
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		n++
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			return nil, fmt.Errorf("%s:%d: no result", path, n)
+		}
+		s, err := StateFromFEN(strings.Join(fields[:4], " "))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		result, err := ParseResult(strings.Join(fields[4:], " "))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+
+		data = append(data, LabeledPosition{s, result})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, errors.New(path + ": no positions")
+	}
+
+	return data, nil
+}
+
+// ParseResult() finds a game result in the given text and returns it as a
+// score for White.
+func ParseResult(text string) (float64, error) {
+	switch {
+	case strings.Contains(text, "1/2-1/2"), strings.Contains(text, "[0.5]"):
+		return 0.5, nil
+	case strings.Contains(text, "1-0"), strings.Contains(text, "[1.0]"):
+		return 1, nil
+	case strings.Contains(text, "0-1"), strings.Contains(text, "[0.0]"):
+		return 0, nil
+	}
+
+	return 0, errors.New("no result in " + text)
+}
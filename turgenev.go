@@ -18,24 +18,184 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
 	"time"
 )
 
 var (
 	SessionStart int64 = time.Now().Unix()
 	verbose bool = false
+
+	// Where PrintLog() writes (nowhere if it's empty)
 	Log string = "/tmp/turgenev.log"
+
+	// How long GameLoop() searches each move (zero to search to its
+	// depth however long that takes)
+	MoveTime time.Duration
+
+	// The default number of goroutines for the subcommands that spread
+	// their work out (the game search itself is single-threaded)
+	Threads int = runtime.NumCPU()
 )
 
-// The main function is primarily for argument parsing...
+// Searches are the search algorithms that can be chosen with -search.
+var Searches = map[string]SearchFunction{
+	"negamax": NegamaxST,
+}
+
+// Subcommands are run by name after the flags, as in "turgenev tune".
+var Subcommands = map[string]func([]string) int{
+	"tune":     Tune,
+	"bench":    Bench,
+	"perft":    Perft,
+	"makebook": MakeBook,
+	"match":    Match,
+	"sprt":     Sprt,
+	"epd":      EPD,
+	"endgames": Endgames,
+}
+
+// The main function is primarily for argument parsing... Subcommands (like
+// "turgenev tune") come after the flags.
 func main() {
-	GameLoop(NegamaxST, 4)
+	search := flag.String("search", "negamax", "search algorithm (negamax or uct)")
+	depth := flag.Int("depth", 4, "search depth in plies (with -time, the most to search; unlimited by default)")
+	flag.DurationVar(&MoveTime, "time", 0, "search each move for this long, e.g. 5s")
+	flag.IntVar(&Threads, "threads", Threads, "default number of goroutines for tune and endgames, and of games at once for match and sprt (each game's search is single-threaded)")
+	pawnHash := flag.Int("pawnhash", 0, "size of each pawn hash table in megabytes (0 for the default)")
+	flag.StringVar(&Log, "log", Log, "log the session to this file (empty for no log)")
+	protocol := flag.String("protocol", "tui", "interface to start in: tui, xboard or uci")
+	fen := flag.String("fen", InitialFEN, "position to start the game from")
+	weights := flag.String("weights", "", "load evaluation weights from a JSON file")
+	book := flag.String("book", "", "play openings from a Polyglot book")
+	syzygy := flag.String("syzygy", "", "probe the Syzygy tablebases in these directories")
+	endgames := flag.String("endgames", "", "probe Turgenev's own endgame tables in this directory")
+	flag.IntVar(&BookDepth, "bookdepth", 0, "leave the book after this many plies (0 for no limit)")
+	flag.BoolVar(&BookBest, "bookbest", false, "play the book's best move instead of a weighted random one")
+	flag.StringVar(&PGNOut, "pgn", "", "save finished games to this PGN file (or a new file in this directory)")
+	flag.BoolVar(&PGNComments, "pgncomments", true, "comment the saved games with the engine's evaluations and times")
+	flag.Usage = usage
+	flag.Parse()
+
+	searchFunction, ok := Searches[*search]
+	if !ok {
+		if *search == "uct" {
+			fmt.Fprintln(os.Stderr, "the UCT search isn't implemented yet")
+		} else {
+			fmt.Fprintln(os.Stderr, "unknown search: " + *search)
+		}
+		os.Exit(2)
+	}
+	if MoveTime > 0 && !flagSet("depth") {
+		*depth = MaxPly / 4
+	}
+	if *depth < 1 || *depth > MaxPly {
+		fmt.Fprintf(os.Stderr, "depth must be between 1 and %d\n", MaxPly)
+		os.Exit(2)
+	}
+	if Threads < 1 {
+		fmt.Fprintln(os.Stderr, "threads must be at least 1")
+		os.Exit(2)
+	}
+	mode := TUI
+	if *protocol != "tui" {
+		var err error
+		if mode, err = ParseProtocol(*protocol); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+	start, err := StateFromFEN(*fen)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if *pawnHash != 0 {
+		if err := SetPawnTableSize(*pawnHash); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	if *weights != "" {
+		if err := LoadParams(*weights); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	if *book != "" {
+		if err := SetBook(*book); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		OwnBook = true
+	}
+	if *syzygy != "" {
+		if err := SetSyzygyPath(*syzygy); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	if *endgames != "" {
+		if err := SetEndgamePath(*endgames); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	// Subcommands
+	if flag.NArg() > 0 {
+		subcommand, ok := Subcommands[flag.Arg(0)]
+		if !ok {
+			fmt.Fprintln(os.Stderr, "unknown subcommand: " + flag.Arg(0))
+			usage()
+			os.Exit(2)
+		}
+		os.Exit(subcommand(flag.Args()[1:]))
+	}
+
+	Mode = mode
+	if Mode == UCI {
+		UCILoop(searchFunction, *depth)
+		return
+	}
+	GameLoop(searchFunction, *depth, start)
+}
+
+// flagSet() returns whether the named flag was given on the command line.
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
 }
 
-// This is the primary game loop...
-func GameLoop(search SearchFunction, depth int) {
-	s := InitialState()
+// usage() prints the flags and the subcommands.
+func usage() {
+	names := make([]string, 0, len(Subcommands))
+	for name := range Subcommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(os.Stderr, "usage: turgenev [flags] [subcommand [subcommand flags]]\n\n")
+	fmt.Fprintf(os.Stderr, "Subcommands (each takes -h): %s\n\nFlags:\n", strings.Join(names, ", "))
+	flag.PrintDefaults()
+}
+
+// This is the primary game loop... It starts from s, and searches each
+// move to the given depth, or for MoveTime if that's set.
+func GameLoop(search SearchFunction, depth int, s *State) {
+	CurrentGame = NewPGNGame(s)
+	seen, draw, ended := map[string]int{positionKey(s): 1}, "", false
 
 	for {
 		if Mode == TUI { PrintState(s, Orientation) }
@@ -43,18 +203,44 @@ func GameLoop(search SearchFunction, depth int) {
 		// The 'Action' a is a hack to drop through and pass
 		// control to the other player.
 		c, a := Prompt(s)
+		if a == StartUCI {
+			UCIIdentify()
+			UCILoop(search, depth)
+			return
+		}
+		if a == EndGame {
+			ended = true
+			break
+		}
+		if a == SetPosition {
+			s, CurrentGame = c, CurrentReplay.Record()
+			seen = map[string]int{positionKey(s): 1}
+			continue
+		}
 		if a == MakeMove {
+			CurrentGame.AddMove(s, c, "")
 			s = c
+			seen[positionKey(s)]++
 			if Mode == TUI { PrintState(s, Orientation) }
-			if s.LegalSuccessors().Len() == 0 {
+			if draw = drawReason(s, seen); draw != "" || !s.HasLegalMove() {
 				verbose = true
 				break
 			}
 		}
 
-		// Call our search function!
+		// Consult the book and the tablebases, then call our search
+		// function!
 		if Mode == TUI { fmt.Printf("Thinking... ") }
-		c = search(s, 4)
+		c, comment := BookMove(s), "book"
+		if c == nil {
+			c, comment = TablebaseMove(s), "tablebase"
+		}
+		lookedUp := c != nil
+		var sc *SearchContext
+		if !lookedUp {
+			c, sc = timedSearch(search, s, depth)
+			comment = SearchComment(sc)
+		}
 
 		// If the search came up empty, break out of the loop.
 		if c == nil {
@@ -62,6 +248,9 @@ func GameLoop(search SearchFunction, depth int) {
 		}
 
 		// Print what we decided on in the appropriate way...
+		if Mode == Xboard && Post && !lookedUp {
+			PrintThinking(s, c, sc)
+		}
 		if Mode == TUI {
 			fmt.Printf("My move: ")
 		} else {
@@ -70,13 +259,68 @@ func GameLoop(search SearchFunction, depth int) {
 		fmt.Println(MoveString(s, c, Coordinate))
 		PrintLog("\t\t\tOUTPUT: move " + MoveString(s, c, Coordinate) + "\n")
 
+		// Record the move, noting which side we're playing.
+		opponent := "?"
+		if Mode == TUI {
+			opponent = "Human"
+		}
+		CurrentGame.SetEngine(s.GetToMove(), opponent)
+		if !PGNComments {
+			comment = ""
+		}
+		CurrentGame.AddMove(s, c, comment)
+
 		s = c
-		if s.LegalSuccessors().Len() == 0 {
+		seen[positionKey(s)]++
+		if draw = drawReason(s, seen); draw != "" || !s.HasLegalMove() {
 			PrintLog("Break point C\n")
 			break
 		}
 	}
 
-	PrintResults(s)
+	// Quitting (or xboard's "result") leaves the game's result as it is;
+	// otherwise the position decides it.
+	switch {
+	case ended:
+	case draw != "":
+		PrintDraw(draw)
+		CurrentGame.SetResult("1/2-1/2")
+	default:
+		PrintResults(s)
+		CurrentGame.SetResult(s.GameResult())
+	}
+	if PGNOut != "" {
+		if err := CurrentGame.Save(PGNOut); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
 }
 
+// drawReason() returns why the game is drawn in s, which seen counts the
+// occurrences of, by the rules PlayGame() applies: threefold repetition,
+// the fifty-move rule or insufficient material. It returns "" if the game
+// goes on or ends in mate or stalemate.
+func drawReason(s *State, seen map[string]int) string {
+	switch {
+	case !s.HasLegalMove():
+		return ""
+	case seen[positionKey(s)] >= 3:
+		return "threefold repetition"
+	case s.HalfmoveClock() >= 100:
+		return "fifty-move rule"
+	case s.insufficientMaterial():
+		return "insufficient material"
+	}
+	return ""
+}
+
+// timedSearch() runs search on s to the given depth, or if MoveTime is set,
+// as deep as it gets in that time (up to the depth). It returns the move
+// and the search's context, which has the rest of its results.
+func timedSearch(search SearchFunction, s *State, depth int) (*State, *SearchContext) {
+	sc := NewSearch(DefaultEvaluator)
+	if MoveTime > 0 {
+		sc.Deadline = time.Now().Add(MoveTime)
+	}
+	return search(sc, s, depth), sc
+}
@@ -0,0 +1,200 @@
+// Copyright 2013 Chad Williamson.
+
+// This file is part of Turgenev, a chess program.
+
+// Turgenev is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// Turgenev is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU
+// General Public License for more details.
+
+// You should have received a copy of the GNU General Public License along
+// with Turgenev. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UCILoop() takes over from GameLoop() once the GUI has asked for UCI (or
+// from the start with -protocol uci), handling commands until "quit".
+func UCILoop(search SearchFunction, depth int) {
+	s := InitialState()
+
+	for {
+		command, args := ReadCommand()
+
+		switch command {
+		case "uci":
+			UCIIdentify()
+		case "isready":
+			UCIPrint("readyok\n")
+		case "setoption":
+			UCISetOption(args)
+		case "ucinewgame":
+			s = InitialState()
+		case "position":
+			if t := UCIPosition(args); t != nil {
+				s = t
+			}
+		case "go":
+			UCIGo(s, search, depth, args)
+		case "quit":
+			os.Exit(0)
+		}
+	}
+}
+
+// UCIIdentify() answers the "uci" command with the engine's name and
+// options.
+func UCIIdentify() {
+	out := "id name Turgenev\nid author Chad Williamson\n"
+	for _, w := range OptionWeights() {
+		out += fmt.Sprintf("option name %s type spin default %d min %d max %d\n",
+				   w.Name, *w.Value, OptionMin(w.Name), optionLimit)
+	}
+	out += "option name " + WeightsFileOption + " type string default <empty>\n"
+	out += fmt.Sprintf("option name %s type check default %t\n", OwnBookOption, OwnBook)
+	out += "option name " + BookFileOption + " type string default <empty>\n"
+	out += fmt.Sprintf("option name %s type spin default %d min 0 max %d\n",
+			   BookDepthOption, BookDepth, MaxPly)
+	out += fmt.Sprintf("option name %s type check default %t\n", BookBestOption, BookBest)
+	out += "option name " + SyzygyPathOption + " type string default <empty>\n"
+	out += "option name " + EndgamePathOption + " type string default <empty>\n"
+	out += fmt.Sprintf("option name %s type check default %t\n", Syzygy50MoveRuleOption,
+			   Syzygy50MoveRule)
+	UCIPrint(out + "uciok\n")
+}
+
+// UCISetOption() handles "setoption name NAME value VALUE".
+func UCISetOption(args []string) {
+	var name, value []string
+	var field *[]string
+
+	for _, arg := range args {
+		switch arg {
+		case "name":
+			field = &name
+		case "value":
+			field = &value
+		default:
+			if field != nil {
+				*field = append(*field, arg)
+			}
+		}
+	}
+
+	err := SetOption(strings.Join(name, " "), strings.Join(value, " "))
+	if err != nil {
+		UCIPrint("info string " + err.Error() + "\n")
+	}
+}
+
+// UCIPrint() writes a line to the GUI and logs it.
+func UCIPrint(str string) {
+	fmt.Printf("%s", str)
+	PrintLog("\t\t\tOUTPUT: " + str)
+}
+
+// UCIPosition() returns the state described by the arguments to a UCI
+// "position" command ("startpos" or "fen" and a FEN, then optionally
+// "moves" and moves), or nil if they can't be understood.
+func UCIPosition(args []string) *State {
+	if len(args) == 0 {
+		return nil
+	}
+
+	var s *State
+	rest := args[1:]
+	switch args[0] {
+	case "startpos":
+		s = InitialState()
+	case "fen":
+		n := 0
+		for n < len(rest) && rest[n] != "moves" {
+			n++
+		}
+		t, err := StateFromFEN(strings.Join(rest[:n], " "))
+		if err != nil {
+			return nil
+		}
+		s, rest = t, rest[n:]
+	default:
+		return nil
+	}
+
+	if len(rest) > 0 && rest[0] == "moves" {
+		for _, move := range rest[1:] {
+			t := StringsToStates(s)[move]
+			if t == nil {
+				return nil
+			}
+			s = t
+		}
+	}
+
+	return s
+}
+
+// UCIGo() runs the search for a UCI "go" command and reports the result.
+// Of the search limits, only "depth" and "movetime" are supported; without
+// a movetime, the -time flag's MoveTime applies.
+func UCIGo(s *State, search SearchFunction, depth int, args []string) {
+	sc := NewSearch(DefaultEvaluator)
+	if MoveTime > 0 {
+		sc.Deadline = time.Now().Add(MoveTime)
+	}
+	for i := 0; i + 1 < len(args); i++ {
+		switch args[i] {
+		case "depth":
+			if d, err := strconv.Atoi(args[i + 1]); err == nil && d > 0 {
+				depth = d
+			}
+		case "movetime":
+			if ms, err := strconv.Atoi(args[i + 1]); err == nil && ms > 0 {
+				sc.Deadline = time.Now().Add(time.Duration(ms) * time.Millisecond)
+				depth = MaxPly / 4
+			}
+		}
+	}
+
+	if c := BookMove(s); c != nil {
+		UCIPrint("info string book move\n")
+		UCIPrint("bestmove " + MoveString(s, c, Coordinate) + "\n")
+		return
+	}
+	if c := TablebaseMove(s); c != nil {
+		move := MoveString(s, c, Coordinate)
+		if wdl, _, ok := s.TablebaseResult(); ok {
+			UCIPrint(fmt.Sprintf("info depth 1 score %s pv %s\n",
+					     ScoreString(TablebaseValue(wdl, 0), UCI), move))
+		}
+		UCIPrint("info string tablebase move\n")
+		UCIPrint("bestmove " + move + "\n")
+		return
+	}
+
+	c := search(sc, s, depth)
+	if c == nil {
+		UCIPrint("bestmove 0000\n")
+		return
+	}
+
+	move := MoveString(s, c, Coordinate)
+	UCIPrint(fmt.Sprintf("info depth %d score %s nodes %d time %d pv %s\n",
+			     sc.LastDepth, ScoreString(sc.LastScore, UCI), sc.Nodes,
+			     sc.WallTime.Nanoseconds() / 1000000, move))
+	UCIPrint(fmt.Sprintf("info string re-searches: %d pvs %d lmr %d aspiration\n",
+			     sc.Stats.PVSResearches, sc.Stats.LMRResearches,
+			     sc.Stats.AspirationResearches))
+	UCIPrint("bestmove " + move + "\n")
+}